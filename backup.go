@@ -4,19 +4,26 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/nrednav/cuid2"
+	"github.com/zeebo/blake3"
 )
 
-func (c *config) backup(targets []string) {
+// Extension of the checksum files uploaded next to archives
+const CHECKSUM_SUFFIX = ".sha256"
+
+func (c *config) backup(targets []string, dryRun bool) {
 	genCuid, err := cuid2.Init(
 		cuid2.WithLength(c.IdLength),
 	)
@@ -36,72 +43,431 @@ func (c *config) backup(targets []string) {
 		}
 	}
 
-	for _, targetName := range targets {
-		target := c.Targets[targetName]
-		remote := c.Remotes[target.Remote]
+	if c.Encryption.enabled() {
+		fileExt += ENCRYPTED_SUFFIX
+	}
+
+	// Chunks and snapshot indexes are encrypted on their own.
+	if c.Archive == ARCHIVE_REPO {
+		fileExt = SNAPSHOT_EXT
+	}
+
+	if dryRun {
+		for _, targetName := range targets {
+			err = printTargetFiles(targetName, c.Targets[targetName])
+
+			if err != nil {
+				log.Printf("Unable to list the files of target %s: %s", targetName, err)
+			}
+		}
+
+		c.BackupList.cleanUp(c.backends, c.Targets, dryRun)
+		c.pruneChunks(dryRun)
+		return
+	}
+
+	c.resumeUploads()
+	c.flushSpool()
 
+	c.uploadSlots = make(map[string]chan struct{})
+
+	for remoteName, remote := range c.Remotes {
+		if remote.Concurrency > 0 {
+			c.uploadSlots[remoteName] = make(chan struct{}, remote.Concurrency)
+		}
+	}
+
+	concurrency := max(c.Concurrency, 1)
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	if concurrency > 1 {
+		log.Printf("Backing up %d targets, up to %d at the same time", len(targets), concurrency)
+	}
+
+	for _, targetName := range targets {
 		backupId := genCuid()
-		date := time.Now()
-		fileName := fmt.Sprintf("%s-%d%s%d-%s.%s", targetName, date.Day(), date.Month().String()[0:3], date.Year(), backupId, fileExt)
-		outPath := path.Join(c.ArchiveDir, fileName)
+		workers <- struct{}{}
+		wg.Add(1)
 
-		log.Printf("-- Backing up target %s with ID %s\n", targetName, backupId)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
 
-		backupStart := time.Now()
+			entry := c.backupTarget(targetName, backupId, fileExt)
+			c.BackupList.append(entry, targetLogger(targetName))
 
-		file, err := c.writeToFileFirst(target, outPath)
+			targetLogger(targetName).Printf("Done with target %s\n", targetName)
+		}()
+	}
 
-		log.Printf("Archival took %.2f seconds", time.Since(backupStart).Seconds())
+	wg.Wait()
 
-		if err != nil {
-			log.Printf("Error in archive creation: %s", err)
-			log.Printf("The file %s will be removed.", outPath)
-			err = os.Remove(outPath)
+	c.BackupList.cleanUp(c.backends, c.Targets, dryRun)
+	c.pruneChunks(dryRun)
+}
 
-			if err != nil {
-				log.Printf("Error while deleting backup file: %s", err)
+// Archives and uploads a single target, running its hooks around the
+// archival.
+//
+// Returns: Backup list entry of the backup
+func (c *config) backupTarget(targetName string, backupId string, fileExt string) (entry listEntry) {
+	target := c.Targets[targetName]
+	remote := c.backends[target.Remote]
+	hooks := c.hooksFor(target)
+	logger := targetLogger(targetName)
+
+	if target.PlayerCheck.enabled() {
+		if status := target.PlayerCheck.wait(logger); status != "" {
+			logger.Printf("Not backing up target %s because players are online", targetName)
+
+			return listEntry{
+				Id:     backupId,
+				Target: targetName,
+				Date:   time.Now().Format(time.RFC3339),
+				Remote: target.Remote,
+				Status: status,
 			}
-			continue
 		}
+	}
+
+	date := time.Now()
+	fileName := fmt.Sprintf("%s-%d%s%d-%s.%s", targetName, date.Day(), date.Month().String()[0:3], date.Year(), backupId, fileExt)
+	outPath := path.Join(c.ArchiveDir, fileName)
+
+	logger.Printf("-- Backing up target %s with ID %s\n", targetName, backupId)
+
+	backupStart := time.Now()
+	entry = listEntry{
+		Id:          backupId,
+		Target:      targetName,
+		Date:        backupStart.Format(time.RFC3339),
+		Remote:      target.Remote,
+		Archive:     c.Archive,
+		Compression: c.Compression,
+		Status:      STATUS_FAILED,
+	}
+	env := hookEnv{target: targetName, backupId: backupId}
+
+	// Why the backup failed, passed to the onFailure hook
+	var backupErr error
+
+	defer func() {
+		entry.Duration = time.Since(backupStart).Seconds()
+
+		if !entry.succeeded() && hooks.OnFailure != "" {
+			env.remoteUrl = entry.FilePath
+			env.err = backupErr
+			hooks.run("onFailure", hooks.OnFailure, env)
+		}
+	}()
+
+	if hooks.PreCommand != "" {
+		backupErr = hooks.run("preCommand", hooks.PreCommand, env)
+
+		if backupErr != nil && hooks.PreCommandFailure != HOOK_CONTINUE {
+			logger.Printf("Skipping target %s because its pre-backup command failed", targetName)
+			return entry
+		}
+	}
+
+	source := c.archiveSourceFor(targetName, target, backupId)
+
+	if source.parent != nil {
+		entry.Parent = source.parent.BackupId
+	}
+
+	savingPaused := false
+
+	// Streamed archives turn saving back on as soon as every file has been
+	// read, while the upload is still finishing.
+	resumeSaving := sync.OnceFunc(func() {
+		if savingPaused {
+			target.Rcon.resumeSaving(logger)
+		}
+	})
+
+	// Runs once the archive has been written, whether that succeeded or not.
+	archived := func() {
+		resumeSaving()
+
+		if hooks.PostCommand != "" {
+			hooks.run("postCommand", hooks.PostCommand, env)
+		}
+	}
+
+	if target.Rcon.enabled() {
+		backupErr = target.Rcon.pauseSaving(logger)
+
+		if backupErr != nil {
+			logger.Printf("Skipping target %s because saving couldn't be paused: %s", targetName, backupErr)
+			archived()
+			return entry
+		}
+
+		savingPaused = true
+	}
 
-		defer file.Close()
-		var dest string
+	var archive *archiveWriter
+	var err error
 
-		switch remote.Type {
-		case "copyparty":
-			dest, err = c.copypartyUpload(target.Remote, outPath, fileName)
-		case "nextcloud":
-			dest, err = c.nextcloudUpload(target.Remote, outPath, fileName)
+	if c.Archive == ARCHIVE_REPO {
+		release := c.takeUploadSlot(target.Remote, logger)
+		var filePath string
+		filePath, archive, err = c.backupToRepo(remote, source, fileName)
+		release()
+
+		logger.Printf("Backup to the repository took %.2f seconds", time.Since(backupStart).Seconds())
+
+		// A failed upload leaves nothing to delete when the entry is pruned.
+		if err == nil {
+			entry.FilePath = filePath
+			entry.Status = STATUS_OK
 		}
 
+		env.remoteUrl = entry.FilePath
+		archived()
+
 		if err != nil {
-			log.Printf("Error while uploading file to %s/%s because:\n%s", target.Remote, fileName, err)
+			logger.Printf("Error while backing up to the repository on %s because:\n%s", target.Remote, err)
+			backupErr = err
 		}
+	} else if streamer, ok := c.streamerFor(target.Remote); ok {
+		release := c.takeUploadSlot(target.Remote, logger)
+		var filePath string
+		filePath, archive, err = c.streamToRemote(streamer, source, fileName, resumeSaving)
+		release()
+
+		logger.Printf("Archival and upload took %.2f seconds", time.Since(backupStart).Seconds())
+
+		// A failed upload leaves nothing to delete when the entry is pruned.
+		if err == nil {
+			entry.FilePath = filePath
+			entry.Status = STATUS_OK
+		}
+
+		env.remoteUrl = entry.FilePath
+		archived()
+
+		if err != nil {
+			logger.Printf("Error while streaming archive to %s/%s because:\n%s", target.Remote, fileName, err)
+			backupErr = err
+		}
+	} else {
+		archive, err = c.writeToFileFirst(source, outPath)
+
+		logger.Printf("Archival took %.2f seconds", time.Since(backupStart).Seconds())
 
-		if c.DeleteAfterUpload {
-			log.Printf("Deleting %s...", outPath)
+		// Runs before the upload, so services are only stopped while the
+		// archive is being written.
+		env.archivePath = outPath
+		archived()
+
+		if err != nil {
+			logger.Printf("Error in archive creation: %s", err)
+			backupErr = err
+
+			logger.Printf("The file %s will be removed.", outPath)
 			err = os.Remove(outPath)
 
 			if err != nil {
-				log.Printf("Error while deleting backup file: %s", err)
+				logger.Printf("Error while deleting backup file: %s", err)
+			}
+		} else {
+			// Recorded in the backup list if the upload is finished by a
+			// later run.
+			pending := entry
+			pending.Size = archive.size
+			pending.Sha256 = archive.checksum()
+			pending.Blake3 = archive.blake3Checksum()
+			pending.Duration = time.Since(backupStart).Seconds()
+			pending.Status = STATUS_OK
+
+			release := c.takeUploadSlot(target.Remote, logger)
+			var filePath string
+			filePath, err = c.uploadSaved(remote, outPath, fileName, uploadStatePath(fileName), pending, logger)
+			release()
+
+			if err != nil {
+				logger.Printf("Error while uploading file to %s/%s because:\n%s", target.Remote, fileName, err)
+				backupErr = err
+
+				// Keeps the archive so the upload can be tried again.
+				if spoolErr := c.spoolArchive(outPath, fileName, pending, logger); spoolErr != nil {
+					logger.Printf("Unable to move the archive into the spool, it's left at %s: %s", outPath, spoolErr)
+				} else {
+					entry = pending
+					entry.Status = STATUS_SPOOLED
+				}
+			} else {
+				entry.FilePath = filePath
+				entry.Status = STATUS_OK
+
+				if c.DeleteAfterUpload {
+					logger.Printf("Deleting %s...", outPath)
+					err = os.Remove(outPath)
+
+					if err != nil {
+						logger.Printf("Error while deleting backup file: %s", err)
+					}
+				}
+			}
+		}
+	}
+
+	if entry.Status == STATUS_OK {
+		if source.manifest != nil {
+			err = source.manifest.save(targetName)
+
+			// The next backup is then based on an older one, which still works.
+			if err != nil {
+				logger.Printf("Error while saving the manifest: %s", err)
 			}
 		}
 
-		c.BackupList.append(listEntry{
-			Id:       backupId,
-			Date:     backupStart.Format(time.RFC3339),
-			Remote:   target.Remote,
-			FilePath: dest,
-		})
+		entry.Size = archive.size
+		entry.Sha256 = archive.checksum()
+		entry.Blake3 = archive.blake3Checksum()
+		entry.ChecksumFile, err = c.uploadChecksumFile(remote, fileName, archive.checksum(), logger)
+
+		if err != nil {
+			logger.Printf("Error while uploading checksum file: %s", err)
+		}
+	}
+
+	return entry
+}
+
+// Returns a logger which prefixes messages with the target's name, so the
+// output of targets that are backed up at the same time can be told apart.
+func targetLogger(targetName string) *log.Logger {
+	return log.New(log.Writer(), "["+targetName+"] ", log.Flags()|log.Lmsgprefix)
+}
+
+// Waits until another upload to the remote can start if the remote has a
+// concurrency limit.
+//
+// Returns: Function that frees the slot again once the upload is done
+func (c *config) takeUploadSlot(remoteName string, logger *log.Logger) func() {
+	slots, limited := c.uploadSlots[remoteName]
+
+	if !limited {
+		return func() {}
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		logger.Printf("Waiting for another upload to remote %s to finish", remoteName)
+		slots <- struct{}{}
+	}
+
+	return func() { <-slots }
+}
+
+// Counts and hashes everything written to an archive.
+type archiveWriter struct {
+	io.Writer
+	hash hash.Hash
+	size int64
+
+	// nil unless BLAKE3 checksums are enabled
+	blake3 hash.Hash
+}
+
+func (c *config) newArchiveWriter(output io.Writer) *archiveWriter {
+	archive := &archiveWriter{hash: sha256.New()}
+	writers := []io.Writer{output, archive.hash}
+
+	if c.Blake3 {
+		archive.blake3 = blake3.New()
+		writers = append(writers, archive.blake3)
+	}
+
+	archive.Writer = io.MultiWriter(writers...)
+	return archive
+}
+
+func (a *archiveWriter) Write(buf []byte) (int, error) {
+	n, err := a.Writer.Write(buf)
+	a.size += int64(n)
+	return n, err
+}
+
+// Returns: Hex encoded SHA-256 of the archive
+func (a *archiveWriter) checksum() string {
+	return hex.EncodeToString(a.hash.Sum(nil))
+}
+
+// Returns: Hex encoded BLAKE3 of the archive, or nothing if it's disabled
+func (a *archiveWriter) blake3Checksum() string {
+	if a.blake3 == nil {
+		return ""
+	}
+
+	return hex.EncodeToString(a.blake3.Sum(nil))
+}
 
-		log.Printf("Done with target %s\n", targetName)
+// Uploads an archive that was saved to disk first. entry is its backup, with
+// the archive's size and checksum. The progress of remotes that can resume
+// uploads is saved to statePath.
+//
+// Returns: Destination path, Error
+func (c *config) uploadSaved(remote Remote, archivePath string, fileName string, statePath string, entry listEntry, logger *log.Logger) (string, error) {
+	if resumable, ok := remote.(resumableRemote); ok {
+		return uploadResumable(resumable, archivePath, fileName, statePath, entry, logger)
 	}
 
-	c.BackupList.cleanUp()
+	return uploadArchive(remote, archivePath, fileName, entry.Size, entry.Sha256, logger)
 }
 
-func (c *config) writeToFileFirst(target target, outPath string) (*os.File, error) {
-	log.Printf("Saving backup at %s", outPath)
+// Uploads the archive at outPath. Remotes that can verify checksums are given
+// the archive's checksum.
+//
+// Returns: Destination path, Error
+func uploadArchive(remote Remote, outPath string, fileName string, size int64, checksum string, logger *log.Logger) (string, error) {
+	verifier, ok := remote.(checksumRemote)
+
+	if !ok {
+		return remote.Upload(outPath, fileName, logger)
+	}
+
+	file, err := os.Open(outPath)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while opening input file: %w", err)
+	}
+
+	defer file.Close()
+
+	return verifier.UploadStreamWithChecksum(file, size, fileName, func() string { return checksum }, logger)
+}
+
+// Uploads a file in the format of sha256sum next to the archive, for remotes
+// that can't verify checksums themselves.
+//
+// Returns: Destination path of the checksum file, Error
+func (c *config) uploadChecksumFile(remote Remote, fileName string, checksum string, logger *log.Logger) (string, error) {
+	if _, ok := remote.(checksumRemote); ok {
+		return "", nil
+	}
+
+	sumName := fileName + CHECKSUM_SUFFIX
+	sumPath := path.Join(c.ArchiveDir, sumName)
+
+	err := os.WriteFile(sumPath, fmt.Appendf(nil, "%s  %s\n", checksum, fileName), FILE_MODE)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create checksum file: %w", err)
+	}
+
+	defer os.Remove(sumPath)
+
+	return remote.Upload(sumPath, sumName, logger)
+}
+
+func (c *config) writeToFileFirst(source archiveSource, outPath string) (*archiveWriter, error) {
+	source.logger.Printf("Saving backup at %s", outPath)
 
 	file, err := os.Create(outPath)
 
@@ -109,16 +475,112 @@ func (c *config) writeToFileFirst(target target, outPath string) (*os.File, erro
 		return nil, fmt.Errorf("Failed to create output file %w", err)
 	}
 
-	err = c.createArchive(target.Path, file)
+	defer file.Close()
+
+	archive := c.newArchiveWriter(file)
+	err = c.createArchive(source, archive)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return file, nil
+	// The archive may be linked into a local remote or kept in the spool, so
+	// it has to survive a crash.
+	if err = file.Sync(); err != nil {
+		return nil, fmt.Errorf("Failed to flush the archive to disk: %w", err)
+	}
+
+	return archive, file.Close()
+}
+
+// Returns the remote if streaming is enabled for it and it supports streaming.
+func (c *config) streamerFor(remoteName string) (streamingRemote, bool) {
+	if !c.StreamUpload && !c.Remotes[remoteName].Stream {
+		return nil, false
+	}
+
+	streamer, ok := c.backends[remoteName].(streamingRemote)
+	return streamer, ok
+}
+
+// Archives the target straight into the remote's uploader through a pipe
+// without writing the archive to archiveDir. onArchived is called once every
+// file has been read, which may be before the upload is done.
+//
+// Returns: Destination URL, Written archive, Error
+func (c *config) streamToRemote(remote streamingRemote, source archiveSource, fileName string, onArchived func()) (string, *archiveWriter, error) {
+	source.logger.Printf("Streaming archive to remote %s", source.target.Remote)
+
+	reader, writer := io.Pipe()
+	archive := c.newArchiveWriter(writer)
+	archiveErr := make(chan error, 1)
+
+	go func() {
+		err := c.createArchive(source, archive)
+		writer.CloseWithError(err)
+		onArchived()
+		archiveErr <- err
+	}()
+
+	var dest string
+	var err error
+
+	// The reader only reaches EOF after the archiver is done, so the
+	// checksum is complete by the time the remote asks for it.
+	if verifier, ok := remote.(checksumRemote); ok {
+		dest, err = verifier.UploadStreamWithChecksum(reader, -1, fileName, archive.checksum, source.logger)
+	} else {
+		dest, err = remote.UploadStream(reader, -1, fileName, source.logger)
+	}
+
+	// Unblocks the archiver if the upload stopped early.
+	reader.CloseWithError(err)
+
+	archErr := <-archiveErr
+
+	// A failed archiver also fails the upload with the same error.
+	if err != nil {
+		return dest, nil, err
+	}
+
+	if archErr != nil {
+		return dest, nil, fmt.Errorf("Error in archive creation: %w", archErr)
+	}
+
+	return dest, archive, nil
+}
+
+// Writes the archive of the target's directory into output, encrypting it if
+// encryption is enabled.
+func (c *config) createArchive(source archiveSource, output io.Writer) error {
+	rules, err := source.target.ignoreRules()
+
+	if err != nil {
+		return err
+	}
+
+	source.rules = rules
+
+	if !c.Encryption.enabled() {
+		return c.writeArchive(source, output)
+	}
+
+	encrypted, err := c.encrypt(output)
+
+	if err != nil {
+		return fmt.Errorf("Failed to start encryption: %w", err)
+	}
+
+	err = c.writeArchive(source, encrypted)
+
+	if err != nil {
+		return err
+	}
+
+	return encrypted.Close()
 }
 
-func (c *config) createArchive(sourceDir string, output io.Writer) error {
+func (c *config) writeArchive(source archiveSource, output io.Writer) error {
 	switch c.Archive {
 	case "tar":
 		buff := output
@@ -144,32 +606,24 @@ func (c *config) createArchive(sourceDir string, output io.Writer) error {
 			defer writer.Close()
 		}
 
-		return createTar(sourceDir, buff)
+		return createTar(source, buff)
 	case "zip":
-		return createZip(sourceDir, output, c.Compression)
+		return createZip(source, output, c.Compression)
 	}
 
 	return fmt.Errorf("Unrecognized archive format \"%s\"", c.Archive)
 }
 
-func createZip(sourceDir string, output io.Writer, compression string) error {
+func createZip(source archiveSource, output io.Writer, compression string) error {
 	zipWriter := zip.NewWriter(output)
 	defer zipWriter.Close()
 
-	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
+	err := source.walk(func(path string, relPath string, info os.FileInfo) error {
 		header, err := zip.FileInfoHeader(info)
 		if err != nil {
 			return fmt.Errorf("Failed to create tar header: %w", err)
 		}
 
-		relPath, err := filepath.Rel(sourceDir, path)
-		if err != nil {
-			return fmt.Errorf("Failed to get relative path: %w", err)
-		}
 		header.Name = relPath
 
 		if compression == "deflate" {
@@ -185,37 +639,38 @@ func createZip(sourceDir string, output io.Writer, compression string) error {
 			return nil
 		}
 
-		file, err := os.Open(path)
+		return source.copyFile(path, relPath, info, writer)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if deleted := source.deletedList(); deleted != nil {
+		writer, err := zipWriter.Create(DELETED_LIST_NAME)
 		if err != nil {
-			return fmt.Errorf("Failed to open file: %w", err)
+			return fmt.Errorf("Failed to write zip header: %w", err)
 		}
-		defer file.Close()
 
-		_, err = io.Copy(writer, file)
+		_, err = writer.Write(deleted)
 		return err
-	})
+	}
+
+	return nil
 }
 
 // Archive with tar
-func createTar(sourceDir string, output io.Writer) error {
+func createTar(source archiveSource, output io.Writer) error {
 	tarWriter := tar.NewWriter(output)
 	defer tarWriter.Close()
 
-	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
+	err := source.walk(func(path string, relPath string, info os.FileInfo) error {
 		header, err := tar.FileInfoHeader(info, info.Name())
 		if err != nil {
 			return fmt.Errorf("Failed to create tar header: %w", err)
 		}
 
-		relPath, err := filepath.Rel(sourceDir, path)
-		if err != nil {
-			return fmt.Errorf("Failed to get relative path: %w", err)
-		}
-		header.Name = filepath.ToSlash(relPath)
+		header.Name = relPath
 
 		if err := tarWriter.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed to write tar header: %w", err)
@@ -225,13 +680,23 @@ func createTar(sourceDir string, output io.Writer) error {
 			return nil
 		}
 
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("failed to open file: %w", err)
+		return source.copyFile(path, relPath, info, tarWriter)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if deleted := source.deletedList(); deleted != nil {
+		header := &tar.Header{Name: DELETED_LIST_NAME, Mode: 0644, Size: int64(len(deleted)), ModTime: time.Now()}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write tar header: %w", err)
 		}
-		defer file.Close()
 
-		_, err = io.Copy(tarWriter, file)
+		_, err = tarWriter.Write(deleted)
 		return err
-	})
+	}
+
+	return nil
 }
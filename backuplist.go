@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"log"
 	"os"
@@ -16,32 +17,98 @@ import (
 
 type listEntry struct {
 	Id       string
+	Target   string
 	Remote   string
 	FilePath string
 	Date     string
+
+	// Size of the archive in bytes
+	Size        int64
+	Archive     string
+	Compression string
+
+	// Hex encoded SHA-256 of the archive
+	Sha256 string
+
+	// Hex encoded BLAKE3 of the archive, if enabled
+	Blake3 string
+
+	// Path of the checksum file uploaded next to the archive, if any
+	ChecksumFile string
+
+	// ID of the backup an incremental backup is based on. Empty for full
+	// backups.
+	Parent string
+
+	// How long archiving and uploading took in seconds
+	Duration float64
+
+	// One of STATUS_OK, STATUS_FAILED, STATUS_DEFERRED, STATUS_SKIPPED or
+	// STATUS_SPOOLED.
+	// Empty for entries created by older versions, which didn't record
+	// failures.
+	Status string
 }
 
 const LIST_FILE_NAME = "backuplist.json"
 
+const STATUS_OK = "ok"
+const STATUS_FAILED = "failed"
+
+// Not backed up because players were online
+const STATUS_DEFERRED = "deferred"
+const STATUS_SKIPPED = "skipped"
+
+// Archived, but the upload failed so the archive is waiting in the spool
+const STATUS_SPOOLED = "spooled"
+
+// Whether the backup was archived and uploaded successfully.
+func (e listEntry) succeeded() bool {
+	return e.Status == STATUS_OK || e.Status == ""
+}
+
+// Whether the backup succeeded or is in the spool, waiting to be uploaded.
+// Such backups and the backups they are based on have to be kept.
+func (e listEntry) keepWorthy() bool {
+	return e.succeeded() || e.Status == STATUS_SPOOLED
+}
+
 // Appends a new backup to the backup list.
 // Blocking function, Exits immediately if it encounters an error.
-func (b *backupList) append(newBackup listEntry) {
-	if !b.Enabled {
-		return
-	}
-
-	listFile := path.Join(AppFileDir, LIST_FILE_NAME)
-	fileLock := flock.New(listFile + ".lock")
+func (b *backupList) append(newBackup listEntry, logger *log.Logger) {
+	b.update(func(entries []listEntry) []listEntry {
+		return append(entries, newBackup)
+	}, logger)
+}
 
-	log.Println("Locking the list file. This is a blocking operation.")
+// Replaces the entry with the same ID as backup, or appends backup if the
+// entry has been forgotten since.
+// Blocking function, Exits immediately if it encounters an error.
+func (b *backupList) record(backup listEntry, logger *log.Logger) {
+	b.update(func(entries []listEntry) []listEntry {
+		for i := range entries {
+			if entries[i].Id == backup.Id {
+				entries[i] = backup
+				return entries
+			}
+		}
 
-	err := fileLock.Lock()
+		return append(entries, backup)
+	}, logger)
+}
 
-	if err != nil {
-		log.Fatalf("Unable to obtain list file lock: %s", err)
+// Changes the entries in the list file while holding its lock.
+// Blocking function, Exits immediately if it encounters an error.
+func (b *backupList) update(change func([]listEntry) []listEntry, logger *log.Logger) {
+	if !b.Enabled {
+		return
 	}
 
-	log.Println("File locked.")
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+
+	listFile := path.Join(AppFileDir, LIST_FILE_NAME)
+	fileLock := lockListFile(listFile, logger)
 	defer fileLock.Unlock()
 
 	content, err := os.ReadFile(listFile)
@@ -59,7 +126,7 @@ func (b *backupList) append(newBackup listEntry) {
 		}
 	}
 
-	listEntries = append(listEntries, newBackup)
+	listEntries = change(listEntries)
 
 	newContent, err := json.Marshal(listEntries)
 
@@ -74,27 +141,42 @@ func (b *backupList) append(newBackup listEntry) {
 	}
 }
 
-func (b *backupList) cleanUp() {
-	if !b.Enabled || !b.CleanEntries {
-		return
-	}
-
-	listFile := path.Join(AppFileDir, LIST_FILE_NAME)
+// Locks the list file against other runs of QBS.
+// Blocking function, Exits immediately if it encounters an error.
+func lockListFile(listFile string, logger *log.Logger) *flock.Flock {
 	fileLock := flock.New(listFile + ".lock")
 
-	log.Println("Locking the list file. This is a blocking operation.")
+	logger.Println("Locking the list file. This is a blocking operation.")
 
 	err := fileLock.Lock()
 
 	if err != nil {
-		log.Fatalf("Unable to obtain list file lock: %s", err)
+		logger.Fatalf("Unable to obtain list file lock: %s", err)
+	}
+
+	logger.Println("File locked.")
+	return fileLock
+}
+
+// Forgets old entries, and deletes their files from the remotes if
+// DeleteRemote is enabled. In dry run mode, nothing is changed and only what
+// would be removed is printed.
+func (b *backupList) cleanUp(remotes map[string]Remote, targets map[string]target, dryRun bool) {
+	if !b.Enabled || !b.CleanEntries {
+		return
 	}
 
-	log.Println("File locked.")
+	// Runs after every target is done, so nothing else is logging.
+	listFile := path.Join(AppFileDir, LIST_FILE_NAME)
+	fileLock := lockListFile(listFile, log.Default())
 	defer fileLock.Unlock()
 
 	content, err := os.ReadFile(listFile)
 
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
 	if err != nil {
 		log.Fatalf("Unable to read list file: %s", err)
 	}
@@ -106,7 +188,53 @@ func (b *backupList) cleanUp() {
 		log.Fatalf("Unable to parse JSON: %s", err)
 	}
 
-	newContent, err := json.Marshal(b.cleanList(listEntries))
+	newList, oldEntries := b.cleanList(listEntries, targets)
+
+	for _, entry := range oldEntries {
+		if !b.DeleteRemote || entry.FilePath == "" {
+			if dryRun {
+				fmt.Printf("Would forget %s (%s)\n", entry.Id, entry.Date)
+			}
+
+			continue
+		}
+
+		remote, found := remotes[entry.Remote]
+
+		if !found {
+			log.Printf("Keeping entry %s, The remote \"%s\" no longer exists so %s cannot be deleted\n", entry.Id, entry.Remote, entry.FilePath)
+			newList = append(newList, entry)
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would delete %s (%s) from remote %s: %s\n", entry.Id, entry.Date, entry.Remote, entry.FilePath)
+			continue
+		}
+
+		log.Printf("Deleting %s from remote %s...", entry.FilePath, entry.Remote)
+		err := remote.Delete(entry.FilePath)
+
+		if err != nil {
+			log.Printf("Keeping entry %s, Unable to delete its file: %s\n", entry.Id, err)
+			newList = append(newList, entry)
+			continue
+		}
+
+		if entry.ChecksumFile != "" {
+			err = remote.Delete(entry.ChecksumFile)
+
+			if err != nil {
+				log.Printf("Unable to delete checksum file %s: %s\n", entry.ChecksumFile, err)
+			}
+		}
+	}
+
+	if dryRun {
+		return
+	}
+
+	newContent, err := json.Marshal(newList)
 
 	if err != nil {
 		log.Fatalf("Unable to encode to JSON: %s", err)
@@ -120,8 +248,79 @@ func (b *backupList) cleanUp() {
 }
 
 // Not meant for public usage
-func (b *backupList) cleanList(entries []listEntry) []listEntry {
+// Returns: Entries to keep, Entries to prune
+func (b *backupList) cleanList(entries []listEntry, targets map[string]target) ([]listEntry, []listEntry) {
+	groups := make(map[string][]int)
+	var targetNames []string
+
+	for i, entry := range entries {
+		name := entryTarget(entry)
+
+		if _, found := groups[name]; !found {
+			targetNames = append(targetNames, name)
+		}
+
+		groups[name] = append(groups[name], i)
+	}
+
+	decisions := make([]retentionDecision, len(entries))
+
+	for _, name := range targetNames {
+		group := make([]listEntry, len(groups[name]))
+
+		for i, index := range groups[name] {
+			group[i] = entries[index]
+		}
+
+		rules := b.retention
+
+		if target, found := targets[name]; found && target.retention.isSet() {
+			rules = target.retention
+		}
+
+		var groupDecisions []retentionDecision
+
+		if rules.isSet() {
+			groupDecisions = rules.apply(name, group)
+		} else {
+			groupDecisions = b.applyOlderThan(name, group)
+		}
+
+		for i, index := range groups[name] {
+			decisions[index] = groupDecisions[i]
+		}
+	}
+
+	keepParents(decisions)
+	printRetentionTable(decisions)
+
 	var newList []listEntry
+	var oldEntries []listEntry
+
+	for _, decision := range decisions {
+		if decision.keep {
+			newList = append(newList, decision.entry)
+		} else {
+			oldEntries = append(oldEntries, decision.entry)
+		}
+	}
+
+	return newList, oldEntries
+}
+
+// Used when no keep-* rules are configured. Prunes every entry older than
+// OlderThan, except for spooled ones.
+func (b *backupList) applyOlderThan(targetName string, entries []listEntry) []retentionDecision {
+	decisions := make([]retentionDecision, len(entries))
+
+	if b.OlderThan == "" {
+		for i, entry := range entries {
+			decisions[i] = retentionDecision{entry: entry, target: targetName, keep: true, reason: "no retention rules"}
+		}
+
+		return decisions
+	}
+
 	oldDate := time.Now()
 
 	olderThanRaw := strings.SplitSeq(b.OlderThan, " ")
@@ -145,20 +344,73 @@ func (b *backupList) cleanList(entries []listEntry) []listEntry {
 		}
 	}
 
-	log.Printf("Backups older than %s will be forgotten\n", oldDate.Format(time.DateTime))
+	log.Printf("Backups of target \"%s\" older than %s will be forgotten\n", targetName, oldDate.Format(time.DateTime))
 
-	for _, entry := range entries {
+	for i, entry := range entries {
+		decisions[i] = retentionDecision{entry: entry, target: targetName}
 		backupDate, err := time.Parse(time.RFC3339, entry.Date)
 
 		if err != nil {
-			log.Printf("Unable to parse date \"%s\", Skipping entry: %s\n", entry.Date, err)
+			decisions[i].keep = true
+			decisions[i].reason = "unparsable date"
 			continue
 		}
 
-		if backupDate.After(oldDate) {
-			newList = append(newList, entry)
+		if entry.Status == STATUS_SPOOLED {
+			decisions[i].keep = true
+			decisions[i].reason = STATUS_SPOOLED
+		} else if backupDate.After(oldDate) {
+			decisions[i].keep = true
+			decisions[i].reason = "newer than " + b.OlderThan
+		} else {
+			decisions[i].reason = "older than " + b.OlderThan
+		}
+	}
+
+	return decisions
+}
+
+// Reads every entry in the backup list.
+// Blocking function, Exits immediately if it encounters an error.
+func (b *backupList) entries() []listEntry {
+	listFile := path.Join(AppFileDir, LIST_FILE_NAME)
+	fileLock := flock.New(listFile + ".lock")
+
+	err := fileLock.RLock()
+
+	if err != nil {
+		log.Fatalf("Unable to obtain list file lock: %s", err)
+	}
+
+	defer fileLock.Unlock()
+
+	content, err := os.ReadFile(listFile)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		log.Fatalf("Unable to read list file: %s", err)
+	}
+
+	var listEntries []listEntry
+	err = json.Unmarshal(content, &listEntries)
+
+	if err != nil {
+		log.Fatalf("Unable to parse JSON: %s", err)
+	}
+
+	return listEntries
+}
+
+// Looks up a backup by its ID.
+func (b *backupList) find(id string) (listEntry, bool) {
+	for _, entry := range b.entries() {
+		if entry.Id == id {
+			return entry, true
 		}
 	}
 
-	return newList
+	return listEntry{}, false
 }
@@ -4,14 +4,19 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"filippo.io/age"
 	"github.com/BurntSushi/toml"
 )
 
 type (
 	config struct {
-		// A value of either "tar" or "zip"
+		// A value of either "tar", "zip" or "repo"
 		Archive string
 
 		// The directory to save archives to.
@@ -28,14 +33,50 @@ type (
 		// Whether to delete the backup archive after it is uploaded or not.
 		DeleteAfterUpload bool
 
+		// Whether to stream archives directly to every remote that supports
+		// it instead of saving them to ArchiveDir first.
+		StreamUpload bool
+
+		// Whether to also record a BLAKE3 checksum of archives
+		Blake3 bool
+
+		// How many targets are backed up at the same time, 1 if unset
+		Concurrency int
+
 		BackupList backupList
 
+		// Encrypts archives before they are uploaded if set
+		Encryption encryption
+
+		// Where archives of failed uploads are kept until they're uploaded
+		Spool spool
+
+		// Default hooks of targets which don't set their own
+		hooks
+
 		IdLength int
 		Remotes  map[string]remote
 		Targets  map[string]target
 
 		// For internal reference
 		configPath string
+
+		// Remotes created from the Remotes section, by name
+		backends map[string]Remote
+
+		// Limits the uploads to each remote with a concurrency limit. A
+		// slot is taken by sending to the channel.
+		uploadSlots map[string]chan struct{}
+
+		// Parsed from the Encryption section
+		recipients []age.Recipient
+		identities []age.Identity
+
+		// Keys of encrypted repositories by ID, and the key new chunks on
+		// each remote are encrypted with, by remote name
+		repoKeys    map[string]*repoKey
+		remoteKeys  map[string]*repoKey
+		repoKeyLock sync.Mutex
 	}
 
 	remote struct {
@@ -45,18 +86,188 @@ type (
 		Password string
 		Script   string
 		DestDir  string
+
+		// Stream archives to this remote instead of saving them first.
+		Stream bool
+
+		// How many uploads to this remote can run at the same time,
+		// unlimited if unset
+		Concurrency int
+
+		// How failed requests to this remote are retried
+		Retry retryPolicy
+
+		// Upload to a temporary name first, then rename it into place.
+		// Only used by WebDAV remotes.
+		AtomicUpload bool
+
+		// S3 options
+		Endpoint  string
+		Bucket    string
+		Region    string
+		AccessKey string
+		SecretKey string
+
+		// Size of each part of a multipart upload in MiB
+		PartSize int
+
+		// Nextcloud options. The size of each uploaded chunk in MiB, and
+		// how many chunks are uploaded at the same time.
+		ChunkSize      int
+		ParallelChunks int
+
+		// SFTP options
+		Host       string
+		Port       int
+		PrivateKey string
+		KnownHosts string
+	}
+
+	// Exponential backoff for remote operations. Durations are in the
+	// format of time.ParseDuration.
+	retryPolicy struct {
+		// How many times an operation is attempted in total, 1 disables
+		// retrying
+		MaxAttempts int
+
+		// Delay before the first retry, doubled for every further retry
+		BaseDelay string
+		MaxDelay  string
+
+		// Fraction of the delay which is taken off at random, from 0 to 1
+		Jitter *float64
+
+		// HTTP status codes that are retried. Errors without a status code
+		// are always retried.
+		RetryableStatus []int
 	}
 
 	target struct {
 		Path     string
 		Remote   string
 		Interval string
+
+		// gitignore-style patterns of paths to leave out of the archive, and
+		// of paths to archive anyway even though they match an exclude
+		// pattern.
+		Exclude []string
+		Include []string
+
+		// Only archive files that changed since the last backup, making a
+		// full backup every FullEvery runs
+		Incremental bool
+		FullEvery   int
+
+		// Pauses saving of a Minecraft server while it's being archived
+		Rcon rconOptions
+
+		// Holds off the backup while players are online
+		PlayerCheck playerCheck
+
+		// Overrides the retention rules of the backup list for this target
+		retention
+
+		// Overrides the global hook options which are set here
+		hooks
+	}
+
+	rconOptions struct {
+		// host:port of the server's RCON listener
+		Address  string
+		Password string
+
+		// How long to wait for each response, as a Go duration. Defaults
+		// to 1m.
+		Timeout string
+	}
+
+	playerCheck struct {
+		// host:port of the Minecraft server. The port defaults to 25565.
+		Address string
+
+		// Back up only if at most this many players are online
+		MaxPlayers int
+
+		// Either "defer" (the default) to wait until few enough players are
+		// online, or "skip" to not back up this time.
+		Action string
+
+		// How often to check the player count again when deferring, and
+		// how long to keep trying, as Go durations. Default to 10m and 2h.
+		RetryInterval string
+		Deadline      string
+	}
+
+	// Shell commands run around a backup.
+	hooks struct {
+		// Run before the archive is created
+		PreCommand string
+
+		// Run once the archive has been written, even if that failed
+		PostCommand string
+
+		// Run if the backup failed
+		OnFailure string
+
+		// How long a hook may run, as a Go duration. Defaults to 10m.
+		HookTimeout string
+
+		// Either "abort" (the default) to skip the target when PreCommand
+		// fails or "continue" to back it up anyway.
+		PreCommandFailure string
+	}
+
+	// Grandfather-father-son retention rules. The newest backup of each of
+	// the last N days, weeks, months and years is kept.
+	retention struct {
+		KeepLast    int
+		KeepDaily   int
+		KeepWeekly  int
+		KeepMonthly int
+		KeepYearly  int
 	}
 
 	backupList struct {
 		Enabled      bool
 		CleanEntries bool
-		OlderThan    string
+
+		// Only used when no keep-* rules apply to a target
+		OlderThan string
+
+		retention
+
+		// Whether to also delete the files of forgotten entries from their remotes
+		DeleteRemote bool
+
+		// Serializes changes by targets that are backed up at the same
+		// time, before they take the list file lock
+		updateLock sync.Mutex
+	}
+
+	// Archives whose upload failed, which are uploaded again at the start of
+	// the next run or with -flush-spool.
+	spool struct {
+		// Defaults to the spool directory in ArchiveDir
+		Dir string
+
+		// Total size of the spooled archives in MiB, unlimited if unset
+		MaxSize int
+
+		// How long an archive is kept, as a Go duration. Defaults to 168h.
+		MaxAge string
+	}
+
+	// age encryption options. Either Recipients or Passphrase can be used to
+	// encrypt, but not both.
+	encryption struct {
+		// age public keys, or files of them with the file: prefix
+		Recipients []string
+
+		Passphrase string
+
+		// age private keys used to decrypt, or files of them with the file:
+		// prefix. Only needed on machines that restore or verify backups.
+		Identities []string
 	}
 )
 
@@ -84,19 +295,76 @@ func loadConfig(config *config, validate bool) {
 	}
 
 	for remoteName, remote := range config.Remotes {
-		if !strings.HasPrefix(remote.Password, FILE_PREFIX) {
-			continue
+		remote.Password = readSecret(remote.Password, "password", remoteName)
+		remote.SecretKey = readSecret(remote.SecretKey, "secret key", remoteName)
+		config.Remotes[remoteName] = remote
+	}
+
+	for targetName, target := range config.Targets {
+		password, err := readFilePrefix(target.Rcon.Password)
+
+		if err != nil {
+			log.Fatalf("Unable to read RCON password file for target \"%s\"", targetName)
 		}
 
-		filePath := remote.Password[len(FILE_PREFIX):]
-		contents, err := os.ReadFile(filePath)
+		target.Rcon.Password = password
+		config.Targets[targetName] = target
+	}
+
+	config.loadEncryption()
+
+	config.backends = make(map[string]Remote, len(config.Remotes))
+	config.repoKeys = make(map[string]*repoKey)
+	config.remoteKeys = make(map[string]*repoKey)
+
+	for remoteName, remote := range config.Remotes {
+		backend, err := newRemote(remoteName, remote)
 
 		if err != nil {
-			log.Fatalf("Unable to read password file for remote \"%s\"", remoteName)
+			log.Fatalf("Invalid remote \"%s\": %s", remoteName, err)
 		}
 
-		remote.Password = strings.TrimSpace(string(contents))
-		config.Remotes[remoteName] = remote
+		config.backends[remoteName] = backend
+	}
+
+	for targetName, target := range config.Targets {
+		if _, found := config.backends[target.Remote]; !found {
+			log.Fatalf("Target \"%s\" refers to the remote \"%s\" which does not exist", targetName, target.Remote)
+		}
+
+		if _, err := parseIgnoreRules(slices.Concat(target.Exclude, target.Include), false); err != nil {
+			log.Fatalf("Invalid pattern in target \"%s\": %s", targetName, err)
+		}
+
+		if err := config.hooksFor(target).validate(); err != nil {
+			log.Fatalf("Invalid hook options in target \"%s\": %s", targetName, err)
+		}
+
+		if target.Incremental && config.Archive == ARCHIVE_REPO {
+			log.Fatalf("Target \"%s\" is incremental, which can't be combined with the repo archive format", targetName)
+		}
+
+		if target.Incremental && !config.BackupList.Enabled {
+			log.Fatalf("Target \"%s\" is incremental, which requires the backup list to be enabled", targetName)
+		}
+
+		if err := target.PlayerCheck.validate(); err != nil {
+			log.Fatalf("Invalid playerCheck options in target \"%s\": %s", targetName, err)
+		}
+	}
+
+	if config.Spool.Dir == "" {
+		config.Spool.Dir = path.Join(config.ArchiveDir, DEFAULT_SPOOL_DIR)
+	}
+
+	if config.Spool.MaxAge != "" {
+		if _, err := time.ParseDuration(config.Spool.MaxAge); err != nil {
+			log.Fatalf("Invalid spool maxAge \"%s\": %s", config.Spool.MaxAge, err)
+		}
+	}
+
+	if config.Spool.MaxSize < 0 {
+		log.Fatalln("The spool's maxSize can't be negative")
 	}
 
 	if !validate {
@@ -113,3 +381,41 @@ func loadConfig(config *config, validate bool) {
 		}
 	}
 }
+
+// Reads the secret from a file if the value has the file: prefix.
+func readSecret(value string, secretName string, remoteName string) string {
+	secret, err := readFilePrefix(value)
+
+	if err != nil {
+		log.Fatalf("Unable to read %s file for remote \"%s\"", secretName, remoteName)
+	}
+
+	return secret
+}
+
+// Returns: The contents of the file value refers to if it has the file:
+// prefix, otherwise value itself, Error
+func readFilePrefix(value string) (string, error) {
+	if !strings.HasPrefix(value, FILE_PREFIX) {
+		return value, nil
+	}
+
+	contents, err := os.ReadFile(value[len(FILE_PREFIX):])
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// Parses a Go duration, returning fallback if value is empty or invalid.
+func parseDurationOr(value string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+
+	if err != nil || duration <= 0 {
+		return fallback
+	}
+
+	return duration
+}
@@ -1,49 +1,260 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Returns: Destination URL, Error
-func (c *config) copypartyUpload(remoteName string, inputFile string, fileName string) (string, error) {
-	remote := c.Remotes[remoteName]
-	script := remote.Script
+type copypartyRemote struct {
+	name string
+	remote
+
+	// The destination directory URL, <root>/<destDir>
+	destUrl string
+}
 
-	if script == "" {
-		script = "u2c"
+// The parts of copyparty's ?ls response that QBS uses.
+type copypartyListing struct {
+	Files []struct {
+		Href string
+		Sz   int64
+		Ts   int64
 	}
+}
 
-	password := ""
+// Uploads through the u2c script instead of copyparty's HTTP API. u2c needs
+// a local file, so this remote can't stream.
+type u2cRemote struct {
+	api *copypartyRemote
+}
+
+func init() {
+	registerRemote("copyparty", newCopypartyRemote)
+}
 
-	if remote.User != "" {
-		remote.User += ":"
+func newCopypartyRemote(name string, options remote) (Remote, error) {
+	destUrl, err := url.JoinPath(options.Root, options.DestDir)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while URL is being joined: %w", err)
 	}
 
-	if remote.Password != "" {
-		password = fmt.Sprintf("-a %s%s", remote.User, remote.Password)
+	api := &copypartyRemote{name: name, remote: options, destUrl: destUrl}
+
+	if options.Script != "" {
+		return &u2cRemote{api}, nil
 	}
 
-	dest, err := url.JoinPath(remote.Root, remote.DestDir)
+	return api, nil
+}
+
+// Returns: Destination URL, Error
+func (c *copypartyRemote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	file, err := os.Open(inputFile)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while opening input file: %w", err)
+	}
+
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+
+	if err != nil {
+		return "", fmt.Errorf("Error while getting file information: %w", err)
+	}
+
+	return c.UploadStream(file, fileStat.Size(), fileName, logger)
+}
+
+// Uploads input with a single PUT request. An unknown fileSize of -1 makes
+// the request use chunked transfer encoding.
+//
+// Returns: Destination URL, Error
+func (c *copypartyRemote) UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error) {
+	destUrl, err := url.JoinPath(c.destUrl, fileName)
 
 	if err != nil {
 		return "", fmt.Errorf("Error while URL is being joined: %w", err)
 	}
 
-	destWithFile, err := url.JoinPath(dest, fileName)
+	res, err := c.request(http.MethodPut, destUrl, newProgressReader(input, fileSize, logger), fileSize)
+
+	if err != nil {
+		return destUrl, err
+	}
+
+	res.Body.Close()
+
+	logger.Printf("Upload to copyparty target \"%s\" completed. File is uploaded to %s\n", c.name, destUrl)
+	return destUrl, nil
+}
+
+// Returns: Destination URL, Error
+func (u *u2cRemote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	args := []string{}
+	logArgs := []string{}
+
+	if u.api.Password != "" {
+		user := u.api.User
+
+		if user != "" {
+			user += ":"
+		}
+
+		args = append(args, "-a", user+u.api.Password)
+		logArgs = append(logArgs, "-a", "<redacted>")
+	}
+
+	args = append(args, u.api.destUrl, inputFile)
+	logArgs = append(logArgs, u.api.destUrl, inputFile)
+
+	destWithFile, err := url.JoinPath(u.api.destUrl, fileName)
 
 	if err != nil {
 		return "", fmt.Errorf("Error while URL is being joined: %w", err)
 	}
 
-	cmd := exec.Command(script, password, dest, inputFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// u2c resumes the upload of files that were partially uploaded.
+	err = u.api.Retry.do(logger, "Uploading with u2c", func() error {
+		cmd := exec.Command(u.api.Script, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		logger.Printf("Running command: %s %s", u.api.Script, strings.Join(logArgs, " "))
+
+		return cmd.Run()
+	})
+
+	return destWithFile, err
+}
+
+func (u *u2cRemote) List() ([]remoteFile, error) {
+	return u.api.List()
+}
+
+func (u *u2cRemote) Download(fileUrl string, output io.Writer) error {
+	return u.api.Download(fileUrl, output)
+}
+
+func (u *u2cRemote) Delete(fileUrl string) error {
+	return u.api.Delete(fileUrl)
+}
+
+func (u *u2cRemote) Stat(fileUrl string) (remoteFile, error) {
+	return u.api.Stat(fileUrl)
+}
+
+// Sends a request with the remote's credentials and checks the response status.
+// The caller is responsible for closing the response body.
+// A bodySize of -1 means the size is unknown.
+func (c *copypartyRemote) request(method string, fileUrl string, body io.Reader, bodySize int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, fileUrl, body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while creating request: %w", err)
+	}
+
+	if body != nil {
+		req.ContentLength = bodySize
+	}
+
+	if c.Password != "" {
+		// copyparty accepts the password through the PW header, prefixed with
+		// the username when the server runs with --usernames.
+		if c.User != "" {
+			req.Header.Set("PW", c.User+":"+c.Password)
+		} else {
+			req.Header.Set("PW", c.Password)
+		}
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while sending request to copyparty remote \"%s\": %w", c.name, err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("copyparty remote \"%s\" responded with status %s", c.name, res.Status)
+	}
+
+	return res, nil
+}
+
+func (c *copypartyRemote) List() ([]remoteFile, error) {
+	res, err := c.request(http.MethodGet, c.destUrl+"/?ls", nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var listing copypartyListing
+	err = json.NewDecoder(res.Body).Decode(&listing)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse directory listing: %w", err)
+	}
+
+	files := make([]remoteFile, 0, len(listing.Files))
+
+	for _, file := range listing.Files {
+		files = append(files, remoteFile{
+			Path:    c.destUrl + "/" + file.Href,
+			Size:    file.Sz,
+			ModTime: time.Unix(file.Ts, 0),
+		})
+	}
+
+	return files, nil
+}
+
+func (c *copypartyRemote) Download(fileUrl string, output io.Writer) error {
+	res, err := c.request(http.MethodGet, fileUrl, nil, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	_, err = io.Copy(output, res.Body)
+	return err
+}
+
+func (c *copypartyRemote) Delete(fileUrl string) error {
+	res, err := c.request(http.MethodPost, fileUrl+"?delete", nil, 0)
+
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *copypartyRemote) Stat(fileUrl string) (remoteFile, error) {
+	res, err := c.request(http.MethodHead, fileUrl, nil, 0)
+
+	if err != nil {
+		return remoteFile{}, err
+	}
+
+	res.Body.Close()
 
-	log.Printf("Running command: %s", cmd.String())
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
 
-	return destWithFile, cmd.Run()
+	return remoteFile{Path: fileUrl, Size: size, ModTime: modTime}, nil
 }
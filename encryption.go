@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Extension appended to the names of encrypted archives
+const ENCRYPTED_SUFFIX = ".age"
+
+func (e encryption) enabled() bool {
+	return len(e.Recipients) > 0 || e.Passphrase != ""
+}
+
+// Parses the keys of the encryption section. Exits if any of them are invalid.
+func (c *config) loadEncryption() {
+	passphrase, err := readFilePrefix(c.Encryption.Passphrase)
+
+	if err != nil {
+		log.Fatalf("Unable to read encryption passphrase file: %s", err)
+	}
+
+	// age refuses to mix passphrases with other recipients, since anyone
+	// with the passphrase could then find out the other recipients.
+	if passphrase != "" && len(c.Encryption.Recipients) > 0 {
+		log.Fatalln("The encryption section can have either recipients or a passphrase, not both")
+	}
+
+	if passphrase != "" {
+		recipient, err := age.NewScryptRecipient(passphrase)
+
+		if err != nil {
+			log.Fatalf("Invalid encryption passphrase: %s", err)
+		}
+
+		identity, err := age.NewScryptIdentity(passphrase)
+
+		if err != nil {
+			log.Fatalf("Invalid encryption passphrase: %s", err)
+		}
+
+		c.recipients = append(c.recipients, recipient)
+		c.identities = append(c.identities, identity)
+	}
+
+	for _, value := range c.Encryption.Recipients {
+		keys, err := readFilePrefix(value)
+
+		if err != nil {
+			log.Fatalf("Unable to read recipients file: %s", err)
+		}
+
+		// Files may have several recipients, one per line.
+		recipients, err := age.ParseRecipients(strings.NewReader(keys))
+
+		if err != nil {
+			log.Fatalf("Invalid encryption recipient \"%s\": %s", value, err)
+		}
+
+		c.recipients = append(c.recipients, recipients...)
+	}
+
+	for _, value := range c.Encryption.Identities {
+		keys, err := readFilePrefix(value)
+
+		if err != nil {
+			log.Fatalf("Unable to read identity file: %s", err)
+		}
+
+		identities, err := age.ParseIdentities(strings.NewReader(keys))
+
+		if err != nil {
+			// The value itself is left out, as it may be a private key.
+			log.Fatalf("Invalid encryption identity: %s", err)
+		}
+
+		c.identities = append(c.identities, identities...)
+	}
+}
+
+// Returns: A writer which encrypts everything written to it into output and
+// must be closed to finish the file, Error
+func (c *config) encrypt(output io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(output, c.recipients...)
+}
+
+// Returns: A reader of the decrypted contents of input, Error
+func (c *config) decrypt(input io.Reader) (io.Reader, error) {
+	if len(c.identities) == 0 {
+		return nil, errors.New("No identities or passphrase are configured in the encryption section")
+	}
+
+	return age.Decrypt(input, c.identities...)
+}
+
+// Decrypts the age file at inPath into a new file at outPath.
+func (c *config) decryptFile(inPath string, outPath string) error {
+	input, err := os.Open(inPath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to open encrypted file: %w", err)
+	}
+
+	defer input.Close()
+
+	decrypted, err := c.decrypt(input)
+
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt %s: %w", inPath, err)
+	}
+
+	output, err := os.Create(outPath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create output file %w", err)
+	}
+
+	defer output.Close()
+
+	_, err = io.Copy(output, decrypted)
+
+	if err != nil {
+		os.Remove(outPath)
+		return fmt.Errorf("Failed to decrypt %s: %w", inPath, err)
+	}
+
+	return output.Close()
+}
+
+// Implements the -decrypt command, which writes the archive next to the
+// encrypted file without the .age extension.
+func (c *config) decryptCommand(inPath string, force bool) {
+	if !strings.HasSuffix(inPath, ENCRYPTED_SUFFIX) {
+		log.Fatalf("The file %s does not have the %s extension", inPath, ENCRYPTED_SUFFIX)
+	}
+
+	outPath := strings.TrimSuffix(inPath, ENCRYPTED_SUFFIX)
+
+	if _, err := os.Stat(outPath); err == nil && !force {
+		log.Fatalf("The file %s already exists. Use the -force flag to overwrite it.", outPath)
+	}
+
+	err := c.decryptFile(inPath, outPath)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Printf("Decrypted archive saved at %s\n", outPath)
+}
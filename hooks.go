@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const DEFAULT_HOOK_TIMEOUT = 10 * time.Minute
+
+// Values of the preCommandFailure option
+const (
+	HOOK_ABORT    = "abort"
+	HOOK_CONTINUE = "continue"
+)
+
+// Values passed to hooks through QBS_* environment variables. Empty values
+// are left out.
+type hookEnv struct {
+	target      string
+	backupId    string
+	archivePath string
+	remoteUrl   string
+
+	// Why the backup failed, only set for onFailure
+	err error
+}
+
+func (e hookEnv) environ() []string {
+	vars := map[string]string{
+		"QBS_TARGET":       e.target,
+		"QBS_BACKUP_ID":    e.backupId,
+		"QBS_ARCHIVE_PATH": e.archivePath,
+		"QBS_REMOTE_URL":   e.remoteUrl,
+	}
+
+	if e.err != nil {
+		vars["QBS_ERROR"] = e.err.Error()
+	}
+
+	environ := os.Environ()
+
+	for key, value := range vars {
+		if value != "" {
+			environ = append(environ, key+"="+value)
+		}
+	}
+
+	return environ
+}
+
+// Returns the target's hooks, with unset options taken from the global ones.
+func (c *config) hooksFor(target target) hooks {
+	merged := target.hooks
+
+	if merged.PreCommand == "" {
+		merged.PreCommand = c.PreCommand
+	}
+
+	if merged.PostCommand == "" {
+		merged.PostCommand = c.PostCommand
+	}
+
+	if merged.OnFailure == "" {
+		merged.OnFailure = c.OnFailure
+	}
+
+	if merged.HookTimeout == "" {
+		merged.HookTimeout = c.HookTimeout
+	}
+
+	if merged.PreCommandFailure == "" {
+		merged.PreCommandFailure = c.PreCommandFailure
+	}
+
+	return merged
+}
+
+func (h hooks) validate() error {
+	if h.HookTimeout != "" {
+		if _, err := time.ParseDuration(h.HookTimeout); err != nil {
+			return fmt.Errorf("Invalid hookTimeout: %w", err)
+		}
+	}
+
+	switch h.PreCommandFailure {
+	case "", HOOK_ABORT, HOOK_CONTINUE:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown preCommandFailure value \"%s\", Expected one of: %s, %s", h.PreCommandFailure, HOOK_ABORT, HOOK_CONTINUE)
+}
+
+func (h hooks) timeout() time.Duration {
+	return parseDurationOr(h.HookTimeout, DEFAULT_HOOK_TIMEOUT)
+}
+
+// Runs command with sh, killing it if it runs longer than the hook timeout.
+// Errors are logged as well as returned.
+func (h hooks) run(hookName string, command string, env hookEnv) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env.environ()
+
+	// Don't wait forever for children of the shell that are still running.
+	cmd.WaitDelay = 10 * time.Second
+
+	logger := targetLogger(env.target)
+	logger.Printf("Running %s: %s", hookName, command)
+
+	err := cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s timed out after %s", hookName, h.timeout())
+	} else if err != nil {
+		err = fmt.Errorf("%s failed: %w", hookName, err)
+	}
+
+	if err != nil {
+		logger.Printf("Error: %s", err)
+	}
+
+	return err
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the file in a target's directory with additional exclude patterns
+const IGNORE_FILE = ".qbsignore"
+
+// A single gitignore-style pattern.
+type ignoreRule struct {
+	// The pattern split at slashes. Patterns that match at any depth start
+	// with a "**" segment.
+	segments []string
+
+	// Whether matching paths are included again instead of excluded
+	negate bool
+
+	// Whether the pattern only matches directories
+	dirOnly bool
+}
+
+// Exclude patterns in the order they are applied. The last matching pattern
+// decides whether a path is excluded.
+type ignoreRules []ignoreRule
+
+// Parses a pattern in the format of a .gitignore line. Blank lines and
+// comments result in ok being false.
+//
+// Returns: Parsed rule, ok, Error
+func parseIgnoreRule(pattern string) (ignoreRule, bool, error) {
+	pattern = strings.TrimSpace(pattern)
+	var rule ignoreRule
+
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	// Like gitignore, patterns with a slash are relative to the target
+	// directory and patterns without one match a name at any depth.
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	if pattern == "" {
+		return rule, false, fmt.Errorf("Empty pattern")
+	}
+
+	if !anchored {
+		rule.segments = append(rule.segments, "**")
+	}
+
+	for segment := range strings.SplitSeq(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return rule, false, fmt.Errorf("Invalid pattern \"%s\": %w", pattern, err)
+		}
+
+		rule.segments = append(rule.segments, segment)
+	}
+
+	return rule, true, nil
+}
+
+// Parses patterns, one per item. negate turns every pattern into an include
+// pattern.
+func parseIgnoreRules(patterns []string, negate bool) (ignoreRules, error) {
+	var rules ignoreRules
+
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnoreRule(pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if negate {
+			rule.negate = !rule.negate
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Collects the exclude patterns of a target, followed by the ones from its
+// .qbsignore file and then its include patterns, so includes always win.
+func (t target) ignoreRules() (ignoreRules, error) {
+	rules, err := parseIgnoreRules(t.Exclude, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(t.Path, IGNORE_FILE))
+
+	if err == nil {
+		defer file.Close()
+
+		var lines []string
+		scanner := bufio.NewScanner(file)
+
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("Unable to read %s: %w", IGNORE_FILE, err)
+		}
+
+		fileRules, err := parseIgnoreRules(lines, false)
+
+		if err != nil {
+			return nil, fmt.Errorf("Error in %s: %w", IGNORE_FILE, err)
+		}
+
+		rules = append(rules, fileRules...)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Unable to open %s: %w", IGNORE_FILE, err)
+	}
+
+	includeRules, err := parseIgnoreRules(t.Include, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rules, includeRules...), nil
+}
+
+// relPath is relative to the target directory and uses forward slashes.
+func (r ignoreRules) excluded(relPath string, isDir bool) bool {
+	excluded := false
+	segments := strings.Split(relPath, "/")
+
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if matchSegments(rule.segments, segments) {
+			excluded = !rule.negate
+		}
+	}
+
+	return excluded
+}
+
+// Matches a path against a pattern, both split at slashes. A "**" segment
+// matches any number of path segments, including none.
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	// Patterns are validated when they're parsed.
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:])
+}
+
+// Walks sourceDir like filepath.Walk, skipping excluded files and the whole
+// contents of excluded directories. relPath uses forward slashes.
+// excludedFn, if not nil, is called for every excluded path.
+func walkTarget(sourceDir string, rules ignoreRules, walkFn func(filePath string, relPath string, info os.FileInfo) error, excludedFn func(relPath string, info os.FileInfo)) error {
+	return filepath.Walk(sourceDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(sourceDir, filePath)
+
+		if err != nil {
+			return fmt.Errorf("Failed to get relative path: %w", err)
+		}
+
+		relPath = filepath.ToSlash(relPath)
+
+		if relPath != "." && rules.excluded(relPath, info.IsDir()) {
+			if excludedFn != nil {
+				excludedFn(relPath, info)
+			}
+
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		return walkFn(filePath, relPath, info)
+	})
+}
+
+// Prints which files of a target would be archived and which are excluded,
+// without archiving anything.
+func printTargetFiles(targetName string, target target) error {
+	rules, err := target.ignoreRules()
+
+	if err != nil {
+		return err
+	}
+
+	var files, excluded int
+	var size int64
+
+	log.Printf("-- Files of target %s (+ archived, - excluded)\n", targetName)
+
+	// Directories are printed with a trailing slash.
+	displayPath := func(relPath string, info os.FileInfo) string {
+		if info.IsDir() {
+			return relPath + "/"
+		}
+
+		return relPath
+	}
+
+	err = walkTarget(target.Path, rules, func(filePath string, relPath string, info os.FileInfo) error {
+		if relPath == "." {
+			return nil
+		}
+
+		fmt.Printf("+ %s\n", displayPath(relPath, info))
+
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+
+		return nil
+	}, func(relPath string, info os.FileInfo) {
+		excluded++
+		fmt.Printf("- %s\n", displayPath(relPath, info))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d files (%.1f MiB) would be archived, %d paths are excluded\n", files, float64(size)/MEBIBYTE, excluded)
+	return nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Directory next to the backup list with the manifest of each target
+const MANIFEST_DIR = "manifests"
+
+// Name of the archive entry listing the paths deleted since the parent backup
+const DELETED_LIST_NAME = ".qbsgo-deleted"
+
+const DEFAULT_FULL_EVERY = 7
+
+// The state of a target's files at the time of a backup.
+type manifest struct {
+	// ID of the backup this manifest describes
+	BackupId string
+
+	// Number of incremental backups since the last full backup
+	Incrementals int
+
+	// By path relative to the target directory, with forward slashes
+	Files map[string]manifestFile
+}
+
+type manifestFile struct {
+	Size int64
+
+	// Unix time in nanoseconds
+	ModTime int64
+
+	// Hex encoded SHA-256 of the contents, empty for directories
+	Sha256 string
+	Dir    bool
+}
+
+// What goes into an archive.
+type archiveSource struct {
+	target target
+
+	// Loaded from the target when the archive is created
+	rules ignoreRules
+
+	// Files of the parent backup, nil for full backups
+	parent *manifest
+
+	// Filled with the files of this backup while archiving, nil if the
+	// target isn't incremental
+	manifest *manifest
+
+	// Prefixes messages with the target's name
+	logger *log.Logger
+}
+
+func manifestPath(targetName string) string {
+	return path.Join(AppFileDir, MANIFEST_DIR, targetName+".json")
+}
+
+// Returns: Manifest of the target's last backup, or nil if there is none, Error
+func loadManifest(targetName string) (*manifest, error) {
+	content, err := os.ReadFile(manifestPath(targetName))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded manifest
+	err = json.Unmarshal(content, &loaded)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest: %w", err)
+	}
+
+	return &loaded, nil
+}
+
+func (m *manifest) save(targetName string) error {
+	filePath := manifestPath(targetName)
+	err := os.MkdirAll(path.Dir(filePath), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	// Replaces the old manifest in one step, so it's never half written.
+	tempPath := filePath + PARTIAL_SUFFIX
+	err = os.WriteFile(tempPath, content, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, filePath)
+}
+
+// Decides whether the next backup of a target is a full or an incremental
+// one. Full backups are made if the target isn't incremental, every
+// fullEvery runs, and whenever the last backup can't be used as a parent.
+func (c *config) archiveSourceFor(targetName string, target target, backupId string) archiveSource {
+	source := archiveSource{target: target, logger: targetLogger(targetName)}
+
+	if !target.Incremental {
+		return source
+	}
+
+	source.manifest = &manifest{BackupId: backupId, Files: make(map[string]manifestFile)}
+	parent, err := loadManifest(targetName)
+
+	if err != nil {
+		source.logger.Printf("Making a full backup, unable to load the manifest: %s", err)
+		return source
+	}
+
+	if parent == nil {
+		source.logger.Printf("Making a full backup, there is no earlier backup of this target")
+		return source
+	}
+
+	fullEvery := target.FullEvery
+
+	if fullEvery <= 0 {
+		fullEvery = DEFAULT_FULL_EVERY
+	}
+
+	if parent.Incrementals+1 >= fullEvery {
+		source.logger.Printf("Making a full backup, it has been %d backups since the last one", parent.Incrementals+1)
+		return source
+	}
+
+	if entry, found := c.BackupList.find(parent.BackupId); !found || !entry.succeeded() {
+		source.logger.Printf("Making a full backup, the last backup %s is no longer in the backup list", parent.BackupId)
+		return source
+	}
+
+	source.logger.Printf("Making an incremental backup based on %s", parent.BackupId)
+
+	source.parent = parent
+	source.manifest.Incrementals = parent.Incrementals + 1
+	return source
+}
+
+// Walks the target directory like walkTarget. Regular files which haven't
+// changed since the parent backup are recorded in the manifest and skipped.
+func (s archiveSource) walk(walkFn func(filePath string, relPath string, info os.FileInfo) error) error {
+	return walkTarget(s.target.Path, s.rules, func(filePath string, relPath string, info os.FileInfo) error {
+		if s.manifest == nil {
+			return walkFn(filePath, relPath, info)
+		}
+
+		current := manifestFile{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Dir: info.IsDir()}
+
+		if !info.Mode().IsRegular() {
+			s.manifest.Files[relPath] = current
+			return walkFn(filePath, relPath, info)
+		}
+
+		if s.parent != nil {
+			if previous, found := s.parent.Files[relPath]; found && !previous.Dir && previous.Size == current.Size {
+				if previous.ModTime == current.ModTime {
+					current.Sha256 = previous.Sha256
+					s.manifest.Files[relPath] = current
+					return nil
+				}
+
+				// Only the modification time changed, which happens when a
+				// file is rewritten with the same contents.
+				checksum, err := hashFile(filePath)
+
+				if err != nil {
+					return err
+				}
+
+				if checksum == previous.Sha256 {
+					current.Sha256 = checksum
+					s.manifest.Files[relPath] = current
+					return nil
+				}
+			}
+		}
+
+		return walkFn(filePath, relPath, info)
+	}, nil)
+}
+
+// Copies a file into the archive, recording it in the manifest.
+func (s archiveSource) copyFile(filePath string, relPath string, info os.FileInfo, output io.Writer) error {
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to open file: %w", err)
+	}
+
+	defer file.Close()
+
+	if s.manifest == nil {
+		_, err = io.Copy(output, file)
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(output, hash), file)
+
+	if err != nil {
+		return err
+	}
+
+	s.manifest.Files[relPath] = manifestFile{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Sha256:  hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	return nil
+}
+
+// Returns: Contents of the deleted list, or nil for full backups and if
+// nothing was deleted since the parent backup
+func (s archiveSource) deletedList() []byte {
+	if s.parent == nil {
+		return nil
+	}
+
+	var deleted []string
+
+	for relPath := range s.parent.Files {
+		if _, found := s.manifest.Files[relPath]; !found {
+			deleted = append(deleted, relPath)
+		}
+	}
+
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	slices.Sort(deleted)
+	return []byte(strings.Join(deleted, "\n") + "\n")
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to open file: %w", err)
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Removes the paths of a deleted list from destDir.
+func applyDeletedList(destDir string, input io.Reader) error {
+	scanner := bufio.NewScanner(input)
+
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		target, err := safeJoin(destDir, scanner.Text())
+
+		if err != nil {
+			return err
+		}
+
+		err = os.RemoveAll(target)
+
+		if err != nil {
+			return fmt.Errorf("Failed to delete \"%s\": %w", scanner.Text(), err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Follows the parents of an incremental backup back to its full backup.
+//
+// Returns: Backups to restore, oldest first, Error
+func (b *backupList) restoreChain(entry listEntry) ([]listEntry, error) {
+	chain := []listEntry{entry}
+	seen := map[string]bool{entry.Id: true}
+
+	for entry.Parent != "" {
+		parent, found := b.find(entry.Parent)
+
+		if !found {
+			return nil, fmt.Errorf("The backup %s is based on %s, which is no longer in the backup list", entry.Id, entry.Parent)
+		}
+
+		if seen[parent.Id] {
+			return nil, fmt.Errorf("The parents of backup %s form a loop", chain[0].Id)
+		}
+
+		seen[parent.Id] = true
+		chain = append(chain, parent)
+		entry = parent
+	}
+
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// Marks the parents of every kept incremental backup as kept too, since the
+// backup can't be restored without them.
+func keepParents(decisions []retentionDecision) {
+	indexes := make(map[string]int, len(decisions))
+
+	for i, decision := range decisions {
+		indexes[decision.entry.Id] = i
+	}
+
+	for i := range decisions {
+		if !decisions[i].keep || !decisions[i].entry.keepWorthy() {
+			continue
+		}
+
+		child := decisions[i].entry
+
+		for child.Parent != "" {
+			index, found := indexes[child.Parent]
+
+			if !found || decisions[index].keep {
+				break
+			}
+
+			decisions[index].keep = true
+			decisions[index].reason = "parent of " + child.Id
+			child = decisions[index].entry
+		}
+	}
+}
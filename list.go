@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// Options of the -list command. Empty values match every entry.
+type listFilter struct {
+	targets []string
+	remote  string
+	since   time.Time
+	until   time.Time
+}
+
+func (f listFilter) matches(entry listEntry) bool {
+	if len(f.targets) > 0 && !slices.Contains(f.targets, entryTarget(entry)) {
+		return false
+	}
+
+	if f.remote != "" && entry.Remote != f.remote {
+		return false
+	}
+
+	if f.since.IsZero() && f.until.IsZero() {
+		return true
+	}
+
+	date, err := time.Parse(time.RFC3339, entry.Date)
+
+	if err != nil {
+		return false
+	}
+
+	if !f.since.IsZero() && date.Before(f.since) {
+		return false
+	}
+
+	if !f.until.IsZero() && date.After(f.until) {
+		return false
+	}
+
+	return true
+}
+
+// Parses the value of the -since and -until flags, which can either be a
+// date or an RFC 3339 timestamp. Dates are in local time, and include the
+// whole day if endOfDay is set.
+func parseListDate(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if date, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		if endOfDay {
+			date = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+
+		return date, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func (b *backupList) printList(filter listFilter, asJson bool) {
+	var entries []listEntry
+
+	for _, entry := range b.entries() {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if asJson {
+		content, err := json.MarshalIndent(entries, "", "  ")
+
+		if err != nil {
+			log.Fatalf("Unable to encode to JSON: %s", err)
+		}
+
+		fmt.Println(string(content))
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTARGET\tREMOTE\tDATE\tSIZE\tSTATUS\tPATH")
+
+	for _, entry := range entries {
+		status := entry.Status
+
+		if status == "" {
+			status = "unknown"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%.1f MiB\t%s\t%s\n", entry.Id, entryTarget(entry), entry.Remote, entry.Date, float64(entry.Size)/MEBIBYTE, status, entry.FilePath)
+	}
+
+	writer.Flush()
+}
+
+// Returns the newest successful backup of a target.
+func (b *backupList) latest(targetName string) (listEntry, bool) {
+	var newest listEntry
+	var newestDate time.Time
+	found := false
+
+	for _, entry := range b.entries() {
+		if entryTarget(entry) != targetName || !entry.succeeded() || entry.FilePath == "" {
+			continue
+		}
+
+		date, err := time.Parse(time.RFC3339, entry.Date)
+
+		if err != nil || (found && !date.After(newestDate)) {
+			continue
+		}
+
+		newest = entry
+		newestDate = date
+		found = true
+	}
+
+	return newest, found
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A directory on this machine, usually a mounted network share or USB drive.
+type localRemote struct {
+	name string
+	remote
+
+	// Absolute path of <root>/<destDir>
+	dir string
+}
+
+func init() {
+	registerRemote("local", newLocalRemote)
+}
+
+func newLocalRemote(name string, options remote) (Remote, error) {
+	if options.Root == "" {
+		return nil, fmt.Errorf("The root option is required")
+	}
+
+	dir, err := filepath.Abs(filepath.Join(options.Root, options.DestDir))
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get absolute path of the destination: %w", err)
+	}
+
+	return &localRemote{name: name, remote: options, dir: dir}, nil
+}
+
+// Checks that filePath is inside of the remote's directory.
+func (l *localRemote) filePath(filePath string) (string, error) {
+	if filepath.Dir(filePath) != l.dir {
+		return "", fmt.Errorf("The path %s does not belong to local remote \"%s\"", filePath, l.name)
+	}
+
+	return filePath, nil
+}
+
+// Hard links the archive into place when it is on the same filesystem,
+// otherwise it is copied.
+//
+// Returns: Destination path, Error
+func (l *localRemote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	err := os.MkdirAll(l.dir, 0755)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while creating destination directory: %w", err)
+	}
+
+	destPath := filepath.Join(l.dir, fileName)
+	tempPath := filepath.Join(l.dir, partialName(fileName))
+
+	// The link shares the data of inputFile, which has to be on disk before
+	// the link is renamed into place.
+	err = syncFile(inputFile)
+
+	if err == nil {
+		err = os.Link(inputFile, tempPath)
+	}
+
+	if err != nil {
+		file, err := os.Open(inputFile)
+
+		if err != nil {
+			return destPath, fmt.Errorf("Error while opening input file: %w", err)
+		}
+
+		defer file.Close()
+
+		return l.UploadStream(file, -1, fileName, logger)
+	}
+
+	return destPath, l.moveIntoPlace(tempPath, destPath, logger)
+}
+
+// Returns: Destination path, Error
+func (l *localRemote) UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error) {
+	err := os.MkdirAll(l.dir, 0755)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while creating destination directory: %w", err)
+	}
+
+	destPath := filepath.Join(l.dir, fileName)
+	tempPath := filepath.Join(l.dir, partialName(fileName))
+
+	err = copyToFile(tempPath, input)
+
+	if err != nil {
+		os.Remove(tempPath)
+		return destPath, err
+	}
+
+	return destPath, l.moveIntoPlace(tempPath, destPath, logger)
+}
+
+// Writes input into a new file and flushes it to disk.
+func copyToFile(filePath string, input io.Reader) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, FILE_MODE)
+
+	if err != nil {
+		return fmt.Errorf("Error while creating file: %w", err)
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, input)
+
+	if err != nil {
+		return fmt.Errorf("Error while copying file: %w", err)
+	}
+
+	err = file.Sync()
+
+	if err != nil {
+		return fmt.Errorf("Error while syncing file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// Flushes the contents of an existing file to disk.
+func syncFile(filePath string) error {
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return file.Sync()
+}
+
+func (l *localRemote) moveIntoPlace(tempPath string, destPath string, logger *log.Logger) error {
+	err := os.Rename(tempPath, destPath)
+
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Error while moving the file into place: %w", err)
+	}
+
+	// Persists the rename. Syncing directories isn't supported everywhere,
+	// so errors are ignored.
+	if dir, err := os.Open(l.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	logger.Printf("Upload to local target \"%s\" completed. File is saved at %s\n", l.name, destPath)
+	return nil
+}
+
+func (l *localRemote) List() ([]remoteFile, error) {
+	entries, err := os.ReadDir(l.dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while listing files on local remote \"%s\": %w", l.name, err)
+	}
+
+	var files []remoteFile
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		files = append(files, remoteFile{Path: filepath.Join(l.dir, entry.Name()), Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	return files, nil
+}
+
+func (l *localRemote) Download(filePath string, output io.Writer) error {
+	filePath, err := l.filePath(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while opening file on local remote \"%s\": %w", l.name, err)
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(output, file)
+	return err
+}
+
+func (l *localRemote) Delete(filePath string) error {
+	filePath, err := l.filePath(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while deleting file from local remote \"%s\": %w", l.name, err)
+	}
+
+	return nil
+}
+
+func (l *localRemote) Stat(filePath string) (remoteFile, error) {
+	filePath, err := l.filePath(filePath)
+
+	if err != nil {
+		return remoteFile{}, err
+	}
+
+	info, err := os.Stat(filePath)
+
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("Error while getting file information from local remote \"%s\": %w", l.name, err)
+	}
+
+	return remoteFile{Path: filePath, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -27,6 +28,22 @@ func main() {
 	backupFlag := flag.Bool("backup", false, "Whether to backup the specified targets or not")
 	installFlag := flag.Bool("install", false, "Install the systemd service & timer for the specified target(s).")
 	dontAsk := flag.Bool("dontask", false, "If set, The program will not ask for any input.")
+	restoreFlag := flag.String("restore", "", "The ID of a backup in the backup list to download and extract.")
+	restoreToFlag := flag.String("restoreTo", "", "The directory to extract a restored backup into.")
+	forceFlag := flag.Bool("force", false, "Allow restoring into a directory that is not empty, or -decrypt to overwrite an existing file.")
+	pruneFlag := flag.Bool("prune", false, "Clean up old entries of the backup list without backing anything up.")
+	dryRunFlag := flag.Bool("dryrun", false, "Print what would be removed from the backup list and remotes instead of removing it.")
+	listFlag := flag.Bool("list", false, "Print the backup list, filtered by the -targets, -remote, -since and -until flags.")
+	remoteFlag := flag.String("remote", "", "Only list backups uploaded to this remote.")
+	sinceFlag := flag.String("since", "", "Only list backups made at or after this date (YYYY-MM-DD or RFC 3339).")
+	untilFlag := flag.String("until", "", "Only list backups made at or before this date (YYYY-MM-DD or RFC 3339).")
+	jsonFlag := flag.Bool("json", false, "Print -list and -latest output as JSON.")
+	latestFlag := flag.String("latest", "", "Print the path of the newest successful backup of a target.")
+	verifyFlag := flag.Bool("verify", false, "Download backups of the specified targets or IDs again and check that they can be read.")
+	idsFlag := flag.String("ids", "", "A comma seperated list of backup IDs to verify.")
+	sampleFlag := flag.Int("sample", 0, "Only verify this many randomly chosen backups.")
+	decryptFlag := flag.String("decrypt", "", "Decrypt a downloaded .age archive into the plain archive next to it.")
+	flushSpoolFlag := flag.Bool("flush-spool", false, "Upload the archives of failed uploads in the spool again without backing anything up.")
 
 	flag.Parse()
 
@@ -38,6 +55,68 @@ func main() {
 	var config config
 	loadConfig(&config, *installFlag)
 
+	if *restoreFlag != "" {
+		config.restore(*restoreFlag, *restoreToFlag, *forceFlag)
+		os.Exit(0)
+	}
+
+	if *decryptFlag != "" {
+		config.decryptCommand(*decryptFlag, *forceFlag)
+		os.Exit(0)
+	}
+
+	if *pruneFlag {
+		config.BackupList.cleanUp(config.backends, config.Targets, *dryRunFlag)
+		config.pruneChunks(*dryRunFlag)
+		os.Exit(0)
+	}
+
+	if *flushSpoolFlag {
+		config.resumeUploads()
+		config.flushSpool()
+		os.Exit(0)
+	}
+
+	if *latestFlag != "" {
+		printLatest(&config, *latestFlag, *jsonFlag)
+		os.Exit(0)
+	}
+
+	if *verifyFlag {
+		filter := verifyFilter{sample: *sampleFlag}
+
+		if *targetsFlag != "" && *targetsFlag != "all" {
+			filter.targets = strings.Split(*targetsFlag, ",")
+		}
+
+		if *idsFlag != "" {
+			filter.ids = strings.Split(*idsFlag, ",")
+		}
+
+		config.verify(filter)
+		os.Exit(0)
+	}
+
+	if *listFlag {
+		filter := listFilter{remote: *remoteFlag}
+		var err error
+
+		if *targetsFlag != "" && *targetsFlag != "all" {
+			filter.targets = strings.Split(*targetsFlag, ",")
+		}
+
+		if filter.since, err = parseListDate(*sinceFlag, false); err != nil {
+			log.Fatalf("Invalid -since value: %s", err)
+		}
+
+		if filter.until, err = parseListDate(*untilFlag, true); err != nil {
+			log.Fatalf("Invalid -until value: %s", err)
+		}
+
+		config.BackupList.printList(filter, *jsonFlag)
+		os.Exit(0)
+	}
+
 	targets := strings.Split(*targetsFlag, ",")
 
 	if len(targets) == 0 {
@@ -63,6 +142,27 @@ func main() {
 	}
 
 	if *backupFlag {
-		config.backup(targets)
+		config.backup(targets, *dryRunFlag)
 	}
 }
+
+func printLatest(config *config, targetName string, asJson bool) {
+	entry, found := config.BackupList.latest(targetName)
+
+	if !found {
+		log.Fatalf("No successful backup of target \"%s\" was found in the backup list", targetName)
+	}
+
+	if !asJson {
+		fmt.Println(entry.FilePath)
+		return
+	}
+
+	content, err := json.MarshalIndent(entry, "", "  ")
+
+	if err != nil {
+		log.Fatalf("Unable to encode to JSON: %s", err)
+	}
+
+	fmt.Println(string(content))
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nrednav/cuid2"
 	"github.com/studio-b12/gowebdav"
@@ -15,95 +20,480 @@ import (
 
 const MEBIBYTE = 1024 * 1024
 const DEFAULT_CHUNK_SIZE = 50 * MEBIBYTE // 50 MiB
+
+// Nextcloud rejects smaller chunks, except for the last one, when its files
+// are stored in S3.
+const MIN_CHUNK_SIZE_NEXTCLOUD = 5 * MEBIBYTE
 const FILE_MODE = 0644
 
+// The checksum request only returns a few properties, so it shouldn't take
+// long.
+const CHECKSUM_REQUEST_TIMEOUT = time.Minute
+
 // See https://docs.nextcloud.com/server/stable/developer_manual/client_apis/WebDAV/chunking.html
 // for how Nextcloud does its chunking
 
-// Returns: Destination URL, Error
-func (c *config) nextcloudUpload(remoteName string, inputFile string, fileName string) (string, error) {
-	remote := c.Remotes[remoteName]
+// Nextcloud is a WebDAV server with its own file layout and chunked upload
+// protocol, so only uploading differs from a generic WebDAV remote.
+type nextcloudRemote struct {
+	*webdavRemote
+
+	chunkSize int64
+
+	// How many chunks are uploaded at the same time
+	parallelChunks int
 
-	prefixUrl, err := url.JoinPath(remote.Root, "remote.php/dav")
+	// Used for the requests gowebdav can't make
+	httpClient *http.Client
+}
+
+func init() {
+	registerRemote("nextcloud", newNextcloudRemote)
+}
+
+func newNextcloudRemote(name string, options remote) (Remote, error) {
+	prefixUrl, err := url.JoinPath(options.Root, "remote.php/dav")
 
 	if err != nil {
-		return "", fmt.Errorf("Error while joining prefix URL: %w", err)
+		return nil, fmt.Errorf("Error while joining prefix URL: %w", err)
+	}
+
+	chunkSize := int64(DEFAULT_CHUNK_SIZE)
+
+	if options.ChunkSize != 0 {
+		chunkSize = int64(options.ChunkSize) * MEBIBYTE
 	}
 
-	client := gowebdav.NewClient(prefixUrl, remote.User, remote.Password)
+	if chunkSize < MIN_CHUNK_SIZE_NEXTCLOUD {
+		return nil, fmt.Errorf("The chunkSize of remote \"%s\" must be at least %d MiB", name, MIN_CHUNK_SIZE_NEXTCLOUD/MEBIBYTE)
+	}
+
+	return &nextcloudRemote{
+		webdavRemote: &webdavRemote{
+			name:    name,
+			remote:  options,
+			baseUrl: prefixUrl,
+			dirPath: path.Join("files", options.User, options.DestDir),
+		},
+		chunkSize:      chunkSize,
+		parallelChunks: max(options.ParallelChunks, 1),
+		httpClient:     &http.Client{Timeout: CHECKSUM_REQUEST_TIMEOUT},
+	}, nil
+}
 
-	destUrl, err := url.JoinPath(prefixUrl, "files", remote.User, remote.DestDir, fileName)
+// Returns: Destination URL, Error
+func (n *nextcloudRemote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	file, err := os.Open(inputFile)
 
 	if err != nil {
-		return "", fmt.Errorf("Error while joining destination URL: %w", err)
+		return "", fmt.Errorf("Error while opening input file: %w", err)
 	}
 
-	err = client.Connect()
+	defer file.Close()
+
+	fileStat, err := file.Stat()
 
 	if err != nil {
-		return destUrl, fmt.Errorf("Error while connecting to Nextcloud server (Remote \"%s\"): %w", remoteName, err)
+		return "", fmt.Errorf("Error while getting file information: %w", err)
 	}
 
+	return n.UploadStream(file, fileStat.Size(), fileName, logger)
+}
+
+// Returns: Destination URL, Error
+func (n *nextcloudRemote) UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error) {
+	return n.UploadStreamWithChecksum(input, fileSize, fileName, nil, logger)
+}
+
+// Uploads everything read from input in chunks, with up to parallelChunks of
+// them being uploaded at the same time. fileSize may be -1 if it isn't known
+// in advance.
+// If checksum is given, it is sent along with the chunk assembly and compared
+// with the checksum Nextcloud reports afterwards.
+//
+// Returns: Destination URL, Error
+func (n *nextcloudRemote) UploadStreamWithChecksum(input io.Reader, fileSize int64, fileName string, checksum func() string, logger *log.Logger) (string, error) {
+	return n.upload(input, fileSize, fileName, checksum, nil, logger)
+}
+
+// Uploads the archive at inputFile, saving which chunks have been uploaded in
+// state, so the upload can be continued by a later run. Chunks that are
+// already in the chunk folder of state are not uploaded again.
+//
+// Returns: Destination URL, Error
+func (n *nextcloudRemote) UploadResumable(inputFile string, fileName string, state *uploadState, logger *log.Logger) (string, error) {
 	file, err := os.Open(inputFile)
 
 	if err != nil {
-		return destUrl, fmt.Errorf("Error while opening input file: %w", err)
+		return "", fmt.Errorf("Error while opening input file: %w", err)
 	}
 
 	defer file.Close()
 
-	fileStat, err := file.Stat()
+	return n.upload(file, state.Size, fileName, func() string { return state.Sha256 }, state, logger)
+}
+
+// Lists the chunks in a chunk folder.
+//
+// Returns: Sizes of the chunks by their number, Error
+func (n *nextcloudRemote) uploadedChunks(client *gowebdav.Client, chunksFolder string) (map[int]int64, error) {
+	files, err := client.ReadDir(chunksFolder)
 
 	if err != nil {
-		return destUrl, fmt.Errorf("Error while getting file information: %w", err)
+		return nil, err
+	}
+
+	chunks := make(map[int]int64, len(files))
+
+	for _, file := range files {
+		if chunkNum, err := strconv.Atoi(file.Name()); err == nil {
+			chunks[chunkNum] = file.Size()
+		}
 	}
 
-	fileSize := fileStat.Size()
+	return chunks, nil
+}
 
-	client.SetHeader("OC-Total-Length", strconv.FormatInt(fileSize, 10))
+// Creates the chunk folder of an upload, or finds the chunks that were
+// uploaded before when continuing the upload of state.
+//
+// Returns: Chunk folder, Chunk size, Sizes of the uploaded chunks by their
+// number, Error
+func (n *nextcloudRemote) prepareChunkFolder(client *gowebdav.Client, state *uploadState, logger *log.Logger) (string, int64, map[int]int64, error) {
+	if state != nil && state.ChunksFolder != "" {
+		var chunks map[int]int64
+
+		err := n.Retry.do(logger, "Listing uploaded chunks", func() (err error) {
+			chunks, err = n.uploadedChunks(client, state.ChunksFolder)
+			return err
+		})
+
+		if err == nil {
+			logger.Printf("Resuming upload into %s, which has %d chunks. The last run confirmed chunks up to %d.", state.ChunksFolder, len(chunks), state.LastChunk)
+			return state.ChunksFolder, state.ChunkSize, chunks, nil
+		}
 
-	chunksFolder := fmt.Sprintf("uploads/%s/qbsgo-%s", remote.User, cuid2.Generate())
-	err = client.Mkdir(chunksFolder, FILE_MODE)
+		if !gowebdav.IsErrNotFound(err) {
+			return "", 0, nil, fmt.Errorf("Error while listing uploaded chunks: %w", err)
+		}
+
+		// Nextcloud deletes the chunk folders of unfinished uploads after a
+		// while.
+		logger.Printf("The chunk folder %s no longer exists, starting the upload over", state.ChunksFolder)
+	}
+
+	chunksFolder := fmt.Sprintf("uploads/%s/qbsgo-%s", n.User, cuid2.Generate())
+
+	err := n.Retry.do(logger, "Creating the chunk folder", func() error {
+		return client.Mkdir(chunksFolder, FILE_MODE)
+	})
+
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("Error while creating chunk folder: %w", err)
+	}
+
+	if state != nil {
+		state.ChunksFolder = chunksFolder
+		state.ChunkSize = n.chunkSize
+		state.LastChunk = 0
+		state.confirmed = nil
+
+		if err = state.save(); err != nil {
+			return "", 0, nil, fmt.Errorf("Unable to save the upload state: %w", err)
+		}
+	}
+
+	return chunksFolder, n.chunkSize, nil, nil
+}
+
+// state is nil if the upload can't be resumed.
+func (n *nextcloudRemote) upload(input io.Reader, fileSize int64, fileName string, checksum func() string, state *uploadState, logger *log.Logger) (string, error) {
+	client := n.client()
+
+	destUrl, err := url.JoinPath(n.baseUrl, n.dirPath, fileName)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while joining destination URL: %w", err)
+	}
+
+	err = n.Retry.do(logger, "Connecting to Nextcloud", client.Connect)
 
 	if err != nil {
-		return destUrl, fmt.Errorf("Error while creating chunk folder: %w", err)
+		return destUrl, fmt.Errorf("Error while connecting to Nextcloud server (Remote \"%s\"): %w", n.name, err)
+	}
+
+	if fileSize >= 0 {
+		client.SetHeader("OC-Total-Length", strconv.FormatInt(fileSize, 10))
+	}
+
+	chunksFolder, chunkSize, uploadedChunks, err := n.prepareChunkFolder(client, state, logger)
+
+	if err != nil {
+		return destUrl, err
+	}
+
+	// Chunk buffers are reused once their upload is done, so at most
+	// parallelChunks chunks are held in memory.
+	bufferSize := chunkSize
+
+	if fileSize >= 0 && fileSize < bufferSize {
+		bufferSize = max(fileSize, 1)
+	}
+
+	buffers := make(chan []byte, n.parallelChunks)
+	allocated := 0
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		uploadErr error
+		uploaded  int64
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+
+	// Nextcloud assembles chunks in the order of their numbers, whatever
+	// order they were uploaded in.
+	uploadChunk := func(chunkNum int, chunk []byte, buffer []byte) {
+		defer wg.Done()
+
+		chunkPath := fmt.Sprintf("%s/%05d", chunksFolder, chunkNum)
+		err := n.Retry.do(logger, fmt.Sprintf("Uploading chunk %d", chunkNum), func() error {
+			return client.Write(chunkPath, chunk, FILE_MODE)
+		})
+
+		mu.Lock()
+
+		if err != nil && uploadErr == nil {
+			uploadErr = fmt.Errorf("Failed to upload chunk %d: %w", chunkNum, err)
+		}
+
+		if err == nil {
+			uploaded += int64(len(chunk))
+
+			if state != nil {
+				state.confirm(chunkNum, logger)
+			}
+
+			if fileSize >= 0 {
+				logger.Printf("Uploaded chunk %d successfully. (%d/%d MiB, %.2f%%)\n", chunkNum, uploaded/MEBIBYTE, fileSize/MEBIBYTE, float32(uploaded)/float32(fileSize)*100)
+			} else {
+				logger.Printf("Uploaded chunk %d successfully. (%d MiB so far)\n", chunkNum, uploaded/MEBIBYTE)
+			}
+		}
+
+		mu.Unlock()
+		buffers <- buffer
 	}
 
 	var offset int64 = 0
-	chunkNum := 1
+	var readErr error
+
+	for chunkNum := 1; ; chunkNum++ {
+		// Skips chunks that were uploaded by an earlier run. Only files are
+		// resumed, which can always be seeked.
+		if size, found := uploadedChunks[chunkNum]; found && size == min(chunkSize, fileSize-offset) {
+			if _, err := input.(io.Seeker).Seek(size, io.SeekCurrent); err != nil {
+				readErr = fmt.Errorf("Error while skipping chunk: %w", err)
+				break
+			}
+
+			offset += size
+
+			mu.Lock()
+			uploaded += size
+			state.confirm(chunkNum, logger)
+			mu.Unlock()
+
+			if offset >= fileSize {
+				break
+			}
 
-	for offset < fileSize {
-		thisChunkSize := DEFAULT_CHUNK_SIZE
-		if offset+int64(DEFAULT_CHUNK_SIZE) > fileSize {
-			thisChunkSize = int(fileSize - offset)
+			continue
 		}
 
-		chunk := make([]byte, thisChunkSize)
-		bytesRead, err := file.ReadAt(chunk, offset)
+		var buffer []byte
 
-		if err != nil && err != io.EOF {
-			return destUrl, fmt.Errorf("Error while reading chunk: %w", err)
+		if allocated < n.parallelChunks && len(buffers) == 0 {
+			buffer = make([]byte, bufferSize)
+			allocated++
+		} else {
+			buffer = <-buffers
 		}
 
-		chunkPath := fmt.Sprintf("%s/%05d", chunksFolder, chunkNum)
-		err = client.Write(chunkPath, chunk[:bytesRead], FILE_MODE)
+		if failed() {
+			break
+		}
 
-		if err != nil {
-			return destUrl, fmt.Errorf("Failed to upload chunk %d: %w", chunkNum, err)
+		bytesRead, err := io.ReadFull(input, buffer)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			readErr = fmt.Errorf("Error while reading chunk: %w", err)
+			break
 		}
 
 		offset += int64(bytesRead)
-		log.Printf("Uploaded chunk %d successfully. (%d/%d MiB, %.2f%%)\n", chunkNum, offset/MEBIBYTE, fileSize/MEBIBYTE, float32(offset)/float32(fileSize)*100)
 
-		chunkNum++
+		wg.Add(1)
+		go uploadChunk(chunkNum, buffer[:bytesRead], buffer)
+
+		if bytesRead < len(buffer) {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if readErr != nil {
+		return destUrl, readErr
+	}
+
+	if uploadErr != nil {
+		return destUrl, uploadErr
+	}
+
+	if fileSize < 0 {
+		client.SetHeader("OC-Total-Length", strconv.FormatInt(offset, 10))
 	}
 
-	err = client.Rename(fmt.Sprintf("%s/.file", chunksFolder), path.Join("files", remote.User, remote.DestDir, fileName), true)
+	expectedSum := ""
+
+	if checksum != nil {
+		expectedSum = checksum()
+		client.SetHeader("OC-Checksum", "SHA256:"+expectedSum)
+	}
+
+	destPath := path.Join(n.dirPath, fileName)
+	attempt := 0
+
+	err = n.Retry.do(logger, "Assembling the chunks", func() error {
+		attempt++
+		err := client.Rename(fmt.Sprintf("%s/.file", chunksFolder), destPath, true)
+
+		// A proxy may time out while Nextcloud assembles a large file, which
+		// Nextcloud still finishes, deleting the chunk folder.
+		if attempt > 1 && gowebdav.IsErrNotFound(err) && n.assembled(client, destPath, destUrl, offset, expectedSum, logger) {
+			return nil
+		}
+
+		return err
+	})
 
 	if err != nil {
 		return destUrl, fmt.Errorf("Error while assembling file chunks: %w", err)
 	}
 
-	log.Printf("Upload to Nextcloud target \"%s\" completed. File is uploaded to %s\n", remoteName, destUrl)
+	if expectedSum != "" {
+		err = n.verifyChecksum(destUrl, expectedSum, logger)
+
+		if err != nil {
+			return destUrl, err
+		}
+	}
+
+	logger.Printf("Upload to Nextcloud target \"%s\" completed. File is uploaded to %s\n", n.name, destUrl)
 	return destUrl, nil
 }
+
+// Whether an earlier attempt to assemble the chunks succeeded, which is the
+// case if the destination has the expected size and checksum.
+func (n *nextcloudRemote) assembled(client *gowebdav.Client, destPath string, destUrl string, size int64, expectedSum string, logger *log.Logger) bool {
+	info, err := client.Stat(destPath)
+
+	if err != nil || info.Size() != size {
+		return false
+	}
+
+	if expectedSum != "" && n.verifyChecksum(destUrl, expectedSum, logger) != nil {
+		return false
+	}
+
+	logger.Printf("The chunk folder is gone, but the file was already assembled by an earlier attempt")
+	return true
+}
+
+// The parts of a PROPFIND response for oc:checksums that QBS uses.
+type nextcloudChecksums struct {
+	Checksum string `xml:"response>propstat>prop>checksums>checksum"`
+}
+
+// Compares the SHA-256 checksum Nextcloud has stored for a file with expected.
+// Nextcloud stores the OC-Checksum header it was sent without hashing the
+// assembled file, so this only confirms that the header was stored with the
+// file. The archive would have to be downloaded again to confirm its contents.
+func (n *nextcloudRemote) verifyChecksum(fileUrl string, expected string, logger *log.Logger) error {
+	var checksums nextcloudChecksums
+
+	err := n.Retry.do(logger, "Requesting the checksum", func() error {
+		return n.requestChecksums(fileUrl, &checksums)
+	})
+
+	if err != nil {
+		return fmt.Errorf("Error while requesting checksum from Nextcloud: %w", err)
+	}
+
+	// Multiple checksums are separated by spaces, e.g. "SHA1:... MD5:..."
+	for checksum := range strings.FieldsSeq(checksums.Checksum) {
+		algorithm, value, _ := strings.Cut(checksum, ":")
+
+		if !strings.EqualFold(algorithm, "SHA256") {
+			continue
+		}
+
+		if !strings.EqualFold(value, expected) {
+			return fmt.Errorf("Checksum mismatch, Nextcloud stored SHA-256 %s but the archive has %s", value, expected)
+		}
+
+		logger.Printf("Nextcloud stored the SHA-256 checksum of the archive")
+		return nil
+	}
+
+	logger.Printf("Warning: Nextcloud did not report a SHA-256 checksum for %s", fileUrl)
+	return nil
+}
+
+func (n *nextcloudRemote) requestChecksums(fileUrl string, checksums *nextcloudChecksums) error {
+	body := `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+	<d:prop><oc:checksums/></d:prop>
+</d:propfind>`
+
+	req, err := http.NewRequest("PROPFIND", fileUrl, strings.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("Error while creating request: %w", err)
+	}
+
+	req.SetBasicAuth(n.User, n.Password)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	res, err := n.httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	// Lets the retry policy decide by the status code.
+	if res.StatusCode != http.StatusMultiStatus {
+		return gowebdav.NewPathError("PROPFIND", fileUrl, res.StatusCode)
+	}
+
+	err = xml.NewDecoder(res.Body).Decode(checksums)
+
+	if err != nil {
+		return fmt.Errorf("Unable to parse checksum response: %w", err)
+	}
+
+	return nil
+}
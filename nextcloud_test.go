@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Answers like the chunked upload API of a Nextcloud server. The first
+// moveTimeouts chunk assemblies finish, but are answered with a 504 like a
+// proxy that gave up waiting would.
+type fakeNextcloud struct {
+	mu           sync.Mutex
+	folders      map[string]bool
+	chunks       map[string][]byte
+	files        map[string][]byte
+	moveTimeouts int
+
+	// Paths of the uploaded chunks, in order
+	puts []string
+}
+
+func newFakeNextcloud() *fakeNextcloud {
+	return &fakeNextcloud{folders: map[string]bool{}, chunks: map[string][]byte{}, files: map[string][]byte{}}
+}
+
+func (f *fakeNextcloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	filePath, _ := url.PathUnescape(r.URL.Path)
+	filePath = strings.TrimSuffix(filePath, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case "MKCOL":
+		f.folders[filePath] = true
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		f.chunks[filePath] = body
+		f.puts = append(f.puts, filePath)
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		folder := strings.TrimSuffix(filePath, "/.file")
+
+		if !f.folders[folder] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var file []byte
+
+		for _, name := range f.chunkNames(folder) {
+			file = append(file, f.chunks[name]...)
+			delete(f.chunks, name)
+		}
+
+		delete(f.folders, folder)
+		dest, _ := url.Parse(r.Header.Get("Destination"))
+		f.files[dest.Path] = file
+
+		if f.moveTimeouts > 0 {
+			f.moveTimeouts--
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		var responses strings.Builder
+
+		if file, ok := f.files[filePath]; ok {
+			sum := sha256.Sum256(file)
+			writeDavResponse(&responses, filePath, fmt.Sprintf("<d:resourcetype/><d:getcontentlength>%d</d:getcontentlength><oc:checksums><oc:checksum>SHA256:%s</oc:checksum></oc:checksums>", len(file), hex.EncodeToString(sum[:])))
+		} else if f.folders[filePath] {
+			writeDavResponse(&responses, filePath+"/", "<d:resourcetype><d:collection/></d:resourcetype>")
+
+			for _, name := range f.chunkNames(filePath) {
+				writeDavResponse(&responses, name, fmt.Sprintf("<d:resourcetype/><d:getcontentlength>%d</d:getcontentlength>", len(f.chunks[name])))
+			}
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">%s</d:multistatus>`, responses.String())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeDavResponse(responses *strings.Builder, href string, props string) {
+	fmt.Fprintf(responses, "<d:response><d:href>%s</d:href><d:propstat><d:prop>%s</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>", href, props)
+}
+
+// Returns: Paths of the chunks in folder, in order
+func (f *fakeNextcloud) chunkNames(folder string) []string {
+	var names []string
+
+	for name := range f.chunks {
+		if strings.HasPrefix(name, folder+"/") {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+func newTestNextcloudRemote(t *testing.T, fake *fakeNextcloud) *nextcloudRemote {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	jitter := 0.0
+	remote, err := newNextcloudRemote("nextcloud", remote{
+		Root:     server.URL,
+		User:     "qbs",
+		Password: "secret",
+		Retry:    retryPolicy{MaxAttempts: 3, BaseDelay: "1ms", Jitter: &jitter},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nextcloud := remote.(*nextcloudRemote)
+	nextcloud.chunkSize = 1000
+	return nextcloud
+}
+
+func TestNextcloudAssemblyAfterProxyTimeout(t *testing.T) {
+	content := bytes.Repeat([]byte("region"), 1000)
+	sum := sha256.Sum256(content)
+	checksum := func() string { return hex.EncodeToString(sum[:]) }
+
+	tests := []struct {
+		name         string
+		moveTimeouts int
+		checksum     func() string
+		wantErr      bool
+	}{
+		{"no timeout", 0, checksum, false},
+		{"timeout once", 1, checksum, false},
+		{"timeout once without checksum", 1, nil, false},
+		{"timeout once with another checksum", 1, func() string { return strings.Repeat("0", 64) }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeNextcloud()
+			fake.moveTimeouts = test.moveTimeouts
+			nextcloud := newTestNextcloudRemote(t, fake)
+
+			destUrl, err := nextcloud.UploadStreamWithChecksum(bytes.NewReader(content), int64(len(content)), "world.tar.gz", test.checksum, log.New(io.Discard, "", 0))
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("UploadStreamWithChecksum() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			dest, _ := url.Parse(destUrl)
+
+			if !test.wantErr && !bytes.Equal(fake.files[dest.Path], content) {
+				t.Errorf("the assembled file doesn't match the uploaded content")
+			}
+		})
+	}
+}
+
+func TestNextcloudResumeSkipsUploadedChunks(t *testing.T) {
+	// Six chunks, the last one with 500 bytes
+	content := make([]byte, 5500)
+	rand.NewChaCha8([32]byte{}).Read(content)
+	sum := sha256.Sum256(content)
+
+	archivePath := filepath.Join(t.TempDir(), "world.tar.gz")
+
+	if err := os.WriteFile(archivePath, content, FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+
+	const oldFolder = "uploads/qbs/qbsgo-old"
+
+	tests := []struct {
+		name string
+		// Sizes of the chunks in the old chunk folder by their number, nil
+		// if Nextcloud deleted it
+		uploaded map[int]int
+		wantPuts []int
+	}{
+		{"all but the last", map[int]int{1: 1000, 2: 1000, 3: 1000, 4: 1000, 5: 1000}, []int{6}},
+		{"out of order", map[int]int{1: 1000, 3: 1000, 6: 500}, []int{2, 4, 5}},
+		{"cut short", map[int]int{1: 1000, 2: 400, 3: 1000}, []int{2, 4, 5, 6}},
+		{"everything", map[int]int{1: 1000, 2: 1000, 3: 1000, 4: 1000, 5: 1000, 6: 500}, nil},
+		{"empty folder", map[int]int{}, []int{1, 2, 3, 4, 5, 6}},
+		{"folder deleted", nil, []int{1, 2, 3, 4, 5, 6}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeNextcloud()
+			nextcloud := newTestNextcloudRemote(t, fake)
+			davFolder := "/remote.php/dav/" + oldFolder
+
+			if test.uploaded != nil {
+				fake.folders[davFolder] = true
+			}
+
+			for chunkNum, size := range test.uploaded {
+				offset := (chunkNum - 1) * 1000
+				fake.chunks[fmt.Sprintf("%s/%05d", davFolder, chunkNum)] = content[offset : offset+size]
+			}
+
+			state := &uploadState{
+				Size:         int64(len(content)),
+				Sha256:       hex.EncodeToString(sum[:]),
+				ChunksFolder: oldFolder,
+				ChunkSize:    1000,
+				filePath:     filepath.Join(t.TempDir(), "world.tar.gz.json"),
+			}
+
+			destUrl, err := nextcloud.UploadResumable(archivePath, "world.tar.gz", state, log.New(io.Discard, "", 0))
+
+			if err != nil {
+				t.Fatalf("UploadResumable() error = %v", err)
+			}
+
+			var puts []int
+
+			for _, put := range fake.puts {
+				chunkNum, _ := strconv.Atoi(path.Base(put))
+				puts = append(puts, chunkNum)
+			}
+
+			if !slices.Equal(puts, test.wantPuts) {
+				t.Errorf("uploaded chunks %v, want %v", puts, test.wantPuts)
+			}
+
+			dest, _ := url.Parse(destUrl)
+
+			if !bytes.Equal(fake.files[dest.Path], content) {
+				t.Error("the assembled file doesn't match the archive")
+			}
+
+			if state.LastChunk != 6 {
+				t.Errorf("state.LastChunk = %d, want 6", state.LastChunk)
+			}
+
+			if (state.ChunksFolder == oldFolder) != (test.uploaded != nil) {
+				t.Errorf("state.ChunksFolder = %s", state.ChunksFolder)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Packet types of the Source RCON protocol, which Minecraft servers implement
+const (
+	RCON_RESPONSE      = 0
+	RCON_EXEC_COMMAND  = 2
+	RCON_AUTH_RESPONSE = 2
+	RCON_AUTH          = 3
+)
+
+const DEFAULT_RCON_TIMEOUT = time.Minute
+
+// Larger than any response a Minecraft server sends in a single packet
+const MAX_RCON_PACKET_SIZE = 1 * MEBIBYTE
+
+// How many times save-on is attempted before giving up
+const RCON_SAVE_ON_ATTEMPTS = 3
+
+type rconConn struct {
+	conn    net.Conn
+	timeout time.Duration
+	nextId  int32
+}
+
+// Connects to an RCON server and logs in.
+func dialRcon(address string, password string, timeout time.Duration) (*rconConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to RCON server %s: %w", address, err)
+	}
+
+	r := &rconConn{conn: conn, timeout: timeout, nextId: 1}
+	id, err := r.send(RCON_AUTH, password)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Some servers send an empty response before the auth response.
+	for {
+		responseId, packetType, _, err := r.read()
+
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if packetType != RCON_AUTH_RESPONSE {
+			continue
+		}
+
+		if responseId == -1 || responseId != id {
+			conn.Close()
+			return nil, errors.New("RCON authentication failed, check the password")
+		}
+
+		return r, nil
+	}
+}
+
+func (r *rconConn) Close() error {
+	return r.conn.Close()
+}
+
+// Runs a command and waits for its response.
+func (r *rconConn) command(command string) (string, error) {
+	id, err := r.send(RCON_EXEC_COMMAND, command)
+
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		responseId, packetType, body, err := r.read()
+
+		if err != nil {
+			return "", err
+		}
+
+		if packetType == RCON_RESPONSE && responseId == id {
+			return body, nil
+		}
+	}
+}
+
+// Returns: ID of the sent packet, Error
+func (r *rconConn) send(packetType int32, body string) (int32, error) {
+	id := r.nextId
+	r.nextId++
+
+	// ID, type, body, and two null bytes
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	r.conn.SetDeadline(time.Now().Add(r.timeout))
+	_, err := r.conn.Write(packet.Bytes())
+
+	if err != nil {
+		return id, fmt.Errorf("Error while sending RCON packet: %w", err)
+	}
+
+	return id, nil
+}
+
+// Returns: Packet ID, Packet type, Body, Error
+func (r *rconConn) read() (int32, int32, string, error) {
+	r.conn.SetDeadline(time.Now().Add(r.timeout))
+
+	var size int32
+	err := binary.Read(r.conn, binary.LittleEndian, &size)
+
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Error while reading RCON response: %w", err)
+	}
+
+	if size < 10 || size > MAX_RCON_PACKET_SIZE {
+		return 0, 0, "", fmt.Errorf("Invalid RCON packet size %d", size)
+	}
+
+	packet := make([]byte, size)
+	_, err = io.ReadFull(r.conn, packet)
+
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Error while reading RCON response: %w", err)
+	}
+
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	packetType := int32(binary.LittleEndian.Uint32(packet[4:8]))
+	body := string(bytes.TrimRight(packet[8:], "\x00"))
+
+	return id, packetType, body, nil
+}
+
+func (o rconOptions) enabled() bool {
+	return o.Address != ""
+}
+
+func (o rconOptions) timeout() time.Duration {
+	return parseDurationOr(o.Timeout, DEFAULT_RCON_TIMEOUT)
+}
+
+// Turns off automatic saving and waits for the server to write everything to
+// disk, so the world doesn't change while it's being archived.
+func (o rconOptions) pauseSaving(logger *log.Logger) error {
+	conn, err := dialRcon(o.Address, o.Password, o.timeout())
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	logger.Printf("Running save-off through RCON")
+
+	if _, err = conn.command("save-off"); err != nil {
+		return err
+	}
+
+	logger.Printf("Running save-all flush through RCON")
+
+	// The response is only sent once the world has been saved.
+	response, err := conn.command("save-all flush")
+
+	if err != nil {
+		// Don't leave saving turned off if the flush failed.
+		conn.command("save-on")
+		return err
+	}
+
+	logger.Printf("Server responded: %s", response)
+	return nil
+}
+
+// Turns automatic saving back on, reconnecting if needed. Errors are logged
+// since there's nothing else left to do about them.
+func (o rconOptions) resumeSaving(logger *log.Logger) {
+	for attempt := 1; attempt <= RCON_SAVE_ON_ATTEMPTS; attempt++ {
+		logger.Printf("Running save-on through RCON")
+
+		conn, err := dialRcon(o.Address, o.Password, o.timeout())
+
+		if err == nil {
+			_, err = conn.command("save-on")
+			conn.Close()
+		}
+
+		if err == nil {
+			return
+		}
+
+		logger.Printf("Error while running save-on (attempt %d/%d): %s", attempt, RCON_SAVE_ON_ATTEMPTS, err)
+
+		if attempt < RCON_SAVE_ON_ATTEMPTS {
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	logger.Printf("Unable to turn saving back on, run save-on on the server manually!")
+}
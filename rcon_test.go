@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRconPacket(conn net.Conn, id int32, packetType int32, body string) {
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+	conn.Write(packet.Bytes())
+}
+
+func readRconPacket(conn net.Conn) (int32, int32, string, error) {
+	var size int32
+
+	if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+		return 0, 0, "", err
+	}
+
+	packet := make([]byte, size)
+
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return 0, 0, "", err
+	}
+
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	packetType := int32(binary.LittleEndian.Uint32(packet[4:8]))
+	return id, packetType, string(bytes.TrimRight(packet[8:], "\x00")), nil
+}
+
+// Starts an RCON server on localhost which accepts password and answers every
+// command with "ran <command>". emptyFirst sends an empty response before the
+// auth response, like some servers do.
+func startRconServer(t *testing.T, password string, emptyFirst bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		for {
+			id, packetType, body, err := readRconPacket(conn)
+
+			if err != nil {
+				return
+			}
+
+			switch packetType {
+			case RCON_AUTH:
+				if emptyFirst {
+					writeRconPacket(conn, id, RCON_RESPONSE, "")
+				}
+
+				if body != password {
+					id = -1
+				}
+
+				writeRconPacket(conn, id, RCON_AUTH_RESPONSE, "")
+			case RCON_EXEC_COMMAND:
+				writeRconPacket(conn, id, RCON_RESPONSE, "ran "+body)
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestRconCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		emptyFirst bool
+		wantErr    string
+	}{
+		{"correct password", "secret", false, ""},
+		{"empty packet before the auth response", "secret", true, ""},
+		{"wrong password", "wrong", false, "authentication failed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := startRconServer(t, "secret", test.emptyFirst)
+			conn, err := dialRcon(address, test.password, 5*time.Second)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("dialRcon() error = %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("dialRcon() error = %v", err)
+			}
+
+			defer conn.Close()
+
+			response, err := conn.command("save-all flush")
+
+			if err != nil {
+				t.Fatalf("command() error = %v", err)
+			}
+
+			if response != "ran save-all flush" {
+				t.Errorf("command() = %q, want %q", response, "ran save-all flush")
+			}
+		})
+	}
+}
+
+func TestRconInvalidPacketSize(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		readRconPacket(conn)
+		binary.Write(conn, binary.LittleEndian, int32(MAX_RCON_PACKET_SIZE+1))
+	}()
+
+	_, err = dialRcon(listener.Addr().String(), "secret", 5*time.Second)
+
+	if err == nil || !strings.Contains(err.Error(), "Invalid RCON packet size") {
+		t.Fatalf("dialRcon() error = %v, want an invalid packet size", err)
+	}
+}
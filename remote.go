@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup upload destination. Paths passed to Download, Delete and Stat are
+// the ones returned by Upload and List, which are also the paths recorded in
+// the backup list.
+type Remote interface {
+	// Uploads the local file at inputFile under the name fileName. Progress
+	// is logged to logger.
+	// Returns: Destination path, Error
+	Upload(inputFile string, fileName string, logger *log.Logger) (string, error)
+
+	// Lists the files in the remote's destination directory.
+	List() ([]remoteFile, error)
+
+	// Writes the file at filePath into output.
+	Download(filePath string, output io.Writer) error
+
+	Delete(filePath string) error
+
+	Stat(filePath string) (remoteFile, error)
+}
+
+// Implemented by remotes which can upload from a reader without having the
+// whole archive saved locally first.
+type streamingRemote interface {
+	// fileSize may be -1 if it isn't known in advance.
+	// Returns: Destination path, Error
+	UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error)
+}
+
+// Implemented by remotes which can have the server store and verify the
+// checksum of an upload. checksum returns the hex encoded SHA-256 of the
+// input and must only be called after input has been read completely.
+type checksumRemote interface {
+	// fileSize may be -1 if it isn't known in advance.
+	// Returns: Destination path, Error
+	UploadStreamWithChecksum(input io.Reader, fileSize int64, fileName string, checksum func() string, logger *log.Logger) (string, error)
+}
+
+// Implemented by remotes which can continue uploading a file after QBS was
+// stopped in the middle of the upload.
+type resumableRemote interface {
+	// Uploads inputFile like Upload, recording the progress in state.
+	// Returns: Destination path, Error
+	UploadResumable(inputFile string, fileName string, state *uploadState, logger *log.Logger) (string, error)
+}
+
+type remoteFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Creates a remote from its name and its section in the configuration file.
+type remoteFactory func(name string, options remote) (Remote, error)
+
+var remoteTypes = make(map[string]remoteFactory)
+
+// Makes a remote type available to the "type" key of [remotes.*] sections.
+// Meant to be called from init functions.
+func registerRemote(typeName string, factory remoteFactory) {
+	if _, exists := remoteTypes[typeName]; exists {
+		panic(fmt.Sprintf("remote type \"%s\" is registered twice", typeName))
+	}
+
+	remoteTypes[typeName] = factory
+}
+
+func newRemote(name string, options remote) (Remote, error) {
+	factory, found := remoteTypes[options.Type]
+
+	if !found {
+		types := make([]string, 0, len(remoteTypes))
+
+		for typeName := range remoteTypes {
+			types = append(types, typeName)
+		}
+
+		sort.Strings(types)
+
+		return nil, fmt.Errorf("Unknown remote type \"%s\", Expected one of: %s", options.Type, strings.Join(types, ", "))
+	}
+
+	if err := options.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid retry options: %w", err)
+	}
+
+	return factory(name, options)
+}
+
+// Logs how much of a reader has been consumed every PROGRESS_INTERVAL bytes.
+type progressReader struct {
+	io.Reader
+
+	// -1 if the total size isn't known
+	total   int64
+	read    int64
+	nextLog int64
+	logger  *log.Logger
+}
+
+const PROGRESS_INTERVAL = 50 * MEBIBYTE
+
+func newProgressReader(input io.Reader, total int64, logger *log.Logger) *progressReader {
+	return &progressReader{Reader: input, total: total, nextLog: PROGRESS_INTERVAL, logger: logger}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.Reader.Read(buf)
+	p.read += int64(n)
+
+	if p.read >= p.nextLog || (err == io.EOF && p.read > 0) {
+		p.nextLog = p.read + PROGRESS_INTERVAL
+
+		if p.total > 0 {
+			p.logger.Printf("Uploaded %d/%d MiB (%.2f%%)\n", p.read/MEBIBYTE, p.total/MEBIBYTE, float32(p.read)/float32(p.total)*100)
+		} else {
+			p.logger.Printf("Uploaded %d MiB\n", p.read/MEBIBYTE)
+		}
+	}
+
+	return n, err
+}
+
+// Returns the hidden name a file is uploaded under before it's renamed to
+// fileName. It's unique, so uploads of the same file by targets that are
+// backed up at the same time don't overwrite each other.
+func partialName(fileName string) string {
+	return fmt.Sprintf(".%s.%08x%s", fileName, rand.Uint32(), PARTIAL_SUFFIX)
+}
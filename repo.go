@@ -0,0 +1,788 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Value of the archive option which stores backups as deduplicated chunks
+const ARCHIVE_REPO = "repo"
+
+// Extension of snapshot files, which list the files and chunks of a backup
+const SNAPSHOT_EXT = "snapshot"
+
+// Prefix of chunk file names, followed by the chunk's ID
+const CHUNK_PREFIX = "chunk-"
+
+// Version of the snapshot format
+const SNAPSHOT_VERSION = 2
+
+// Chunk boundaries are chosen by the content of files, so inserting data
+// into a file only changes the chunks around it.
+const (
+	MIN_CHUNK_SIZE = 512 * 1024
+	MAX_CHUNK_SIZE = 4 * MEBIBYTE
+
+	// A boundary is found once every 2^20 bytes (1 MiB) on average
+	CHUNK_MASK = uint64(1<<20-1) << 44
+)
+
+// First byte of a chunk or snapshot index before it's encrypted, telling how
+// the rest of it is compressed
+const (
+	CHUNK_UNCOMPRESSED = 0
+	CHUNK_ZSTD         = 1
+)
+
+// Chunks are only deleted if they are older than this, so chunks uploaded by
+// a backup that is still running aren't deleted before its snapshot exists.
+const CHUNK_GRACE_PERIOD = 24 * time.Hour
+
+// Random values for the gear rolling hash. Generated from a fixed seed, as
+// changing them would change every chunk boundary.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	rng := rand.New(rand.NewPCG(0x71627367, 0x6f726570))
+
+	for i := range table {
+		table[i] = rng.Uint64()
+	}
+
+	return table
+}()
+
+// The file uploaded for each backup.
+type snapshotFile struct {
+	Version int
+
+	// Every chunk used by the snapshot, so unused chunks can be found
+	// without decrypting the index
+	Chunks []string
+
+	// zstd compressed JSON of a snapshotIndex, which is also encrypted if
+	// Key is set
+	Index []byte
+
+	// ID of the repository key that the index and chunks are encrypted
+	// with, empty if they aren't encrypted
+	Key string
+}
+
+type snapshotIndex struct {
+	Files []snapshotEntry
+}
+
+type snapshotEntry struct {
+	// Relative to the target directory, with forward slashes
+	Path string
+	Mode os.FileMode
+
+	// Unix time in nanoseconds
+	ModTime int64
+	Size    int64
+
+	// Target of symbolic links
+	Link string
+
+	// Chunk IDs of regular files, in order
+	Chunks []string
+}
+
+// Splits a reader into content-defined chunks.
+type chunker struct {
+	input  io.Reader
+	buf    []byte
+	filled int
+	eof    bool
+}
+
+func newChunker(input io.Reader) *chunker {
+	return &chunker{input: input, buf: make([]byte, MAX_CHUNK_SIZE)}
+}
+
+// Returns: The next chunk, Error. io.EOF once everything has been read.
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && c.filled < len(c.buf) {
+		n, err := io.ReadFull(c.input, c.buf[c.filled:])
+		c.filled += n
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.filled == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.filled
+	var hash uint64
+
+	for i := 0; i < c.filled; i++ {
+		hash = (hash << 1) + gearTable[c.buf[i]]
+
+		if i >= MIN_CHUNK_SIZE && hash&CHUNK_MASK == 0 {
+			cut = i + 1
+			break
+		}
+	}
+
+	chunk := slices.Clone(c.buf[:cut])
+	c.filled = copy(c.buf, c.buf[cut:c.filled])
+
+	return chunk, nil
+}
+
+// Uploads data as a file named fileName.
+//
+// Returns: Destination path, Error
+func (c *config) uploadBytes(remote Remote, data []byte, fileName string, logger *log.Logger) (string, error) {
+	if streamer, ok := remote.(streamingRemote); ok {
+		return streamer.UploadStream(bytes.NewReader(data), int64(len(data)), fileName, logger)
+	}
+
+	// Some remotes upload files under their local name, so the file gets a
+	// directory of its own in case another target uploads the same chunk.
+	tempDir, err := os.MkdirTemp(c.ArchiveDir, "."+fileName+"-")
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	tempPath := path.Join(tempDir, fileName)
+	err = os.WriteFile(tempPath, data, FILE_MODE)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temporary file: %w", err)
+	}
+
+	return remote.Upload(tempPath, fileName, logger)
+}
+
+// Compresses chunks and snapshot indexes before they are uploaded, and
+// encrypts them if key isn't nil. They start with a byte telling whether
+// they were compressed, since the compression option may change between
+// backups that share chunks.
+func (c *config) sealChunk(encoder *zstd.Encoder, key *repoKey, data []byte) []byte {
+	if c.Compression != "none" {
+		data = encoder.EncodeAll(data, []byte{CHUNK_ZSTD})
+	} else {
+		data = append([]byte{CHUNK_UNCOMPRESSED}, data...)
+	}
+
+	if key == nil {
+		return data
+	}
+
+	return key.seal(data)
+}
+
+// Reverses sealChunk.
+func (c *config) openChunk(decoder *zstd.Decoder, key *repoKey, data []byte) ([]byte, error) {
+	if key != nil {
+		var err error
+		data, err = key.open(data)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("The chunk is empty")
+	}
+
+	switch data[0] {
+	case CHUNK_UNCOMPRESSED:
+		return data[1:], nil
+	case CHUNK_ZSTD:
+		return decoder.DecodeAll(data[1:], nil)
+	}
+
+	return nil, fmt.Errorf("Unknown chunk compression %d", data[0])
+}
+
+// Stores the files of a target as chunks on the remote, only uploading chunks
+// which aren't there yet, followed by the snapshot.
+//
+// Returns: Destination path of the snapshot, Snapshot file whose size also
+// includes every uploaded chunk, Error
+func (c *config) backupToRepo(remote Remote, source archiveSource, fileName string) (string, *archiveWriter, error) {
+	rules, err := source.target.ignoreRules()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	source.rules = rules
+
+	// Held until the snapshot is uploaded, since the chunks it reuses may be
+	// unused until then.
+	lock, err := c.lockRepo(remote, REPO_LOCK_BACKUP, source.logger)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer lock.unlock(source.logger)
+
+	remoteFiles, err := listRepo(remote, source.logger)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to list existing chunks: %w", err)
+	}
+
+	stored := make(map[string]bool)
+
+	for _, file := range remoteFiles {
+		if name := path.Base(file.Path); strings.HasPrefix(name, CHUNK_PREFIX) {
+			stored[strings.TrimPrefix(name, CHUNK_PREFIX)] = true
+		}
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer encoder.Close()
+
+	var key *repoKey
+
+	if c.Encryption.enabled() {
+		key, err = c.repoKeyFor(source.target.Remote, remote, remoteFiles, source.logger)
+
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var index snapshotIndex
+	used := make(map[string]bool)
+	var uploaded, reused int64
+
+	storeChunk := func(chunk []byte) (string, error) {
+		id := chunkId(key, chunk)
+		used[id] = true
+
+		if stored[id] {
+			reused += int64(len(chunk))
+			return id, nil
+		}
+
+		data := c.sealChunk(encoder, key, chunk)
+		_, err := c.uploadBytes(remote, data, CHUNK_PREFIX+id, source.logger)
+
+		if err != nil {
+			return "", fmt.Errorf("Error while uploading chunk %s: %w", id, err)
+		}
+
+		stored[id] = true
+		uploaded += int64(len(data))
+		return id, nil
+	}
+
+	err = source.walk(func(filePath string, relPath string, info os.FileInfo) error {
+		entry := snapshotEntry{Path: relPath, Mode: info.Mode(), ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Link, err = os.Readlink(filePath)
+
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			file, err := os.Open(filePath)
+
+			if err != nil {
+				return fmt.Errorf("Failed to open file: %w", err)
+			}
+
+			defer file.Close()
+			chunks := newChunker(file)
+
+			for {
+				chunk, err := chunks.next()
+
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					return fmt.Errorf("Failed to read \"%s\": %w", relPath, err)
+				}
+
+				id, err := storeChunk(chunk)
+
+				if err != nil {
+					return err
+				}
+
+				entry.Chunks = append(entry.Chunks, id)
+			}
+		}
+
+		index.Files = append(index.Files, entry)
+		return nil
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	source.logger.Printf("Uploaded %.1f MiB of new chunks, %.1f MiB were already stored", float64(uploaded)/MEBIBYTE, float64(reused)/MEBIBYTE)
+
+	indexJson, err := json.Marshal(index)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	snapshot := snapshotFile{Version: SNAPSHOT_VERSION, Index: c.sealChunk(encoder, key, indexJson)}
+
+	if key != nil {
+		snapshot.Key = key.id
+	}
+
+	for id := range used {
+		snapshot.Chunks = append(snapshot.Chunks, id)
+	}
+
+	slices.Sort(snapshot.Chunks)
+	content, err := json.Marshal(snapshot)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	outPath := path.Join(c.ArchiveDir, fileName)
+	file, err := os.Create(outPath)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to create output file %w", err)
+	}
+
+	defer os.Remove(outPath)
+	defer file.Close()
+
+	archive := c.newArchiveWriter(file)
+
+	if _, err = archive.Write(content); err != nil {
+		return "", nil, err
+	}
+
+	if err = file.Close(); err != nil {
+		return "", nil, err
+	}
+
+	dest, err := uploadArchive(remote, outPath, fileName, archive.size, archive.checksum(), source.logger)
+
+	// The backup list records how much was uploaded in total
+	archive.size += uploaded
+	return dest, archive, err
+}
+
+// Returns the path of a file in the same remote directory as filePath.
+// Works for every kind of remote path, from URLs to local paths.
+func siblingPath(filePath string, name string) string {
+	return filePath[:strings.LastIndex(filePath, "/")+1] + name
+}
+
+// Downloads the snapshot of a backup, writing its raw contents into hash.
+func (c *config) loadSnapshot(remote Remote, entry listEntry, hash io.Writer) (snapshotFile, error) {
+	var content bytes.Buffer
+	var snapshot snapshotFile
+
+	err := remote.Download(entry.FilePath, io.MultiWriter(&content, hash))
+
+	if err != nil {
+		return snapshot, err
+	}
+
+	err = json.Unmarshal(content.Bytes(), &snapshot)
+
+	if err != nil {
+		return snapshot, fmt.Errorf("Unable to parse snapshot: %w", err)
+	}
+
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return snapshot, fmt.Errorf("Unsupported snapshot version %d", snapshot.Version)
+	}
+
+	return snapshot, nil
+}
+
+func (c *config) readSnapshotIndex(decoder *zstd.Decoder, key *repoKey, snapshot snapshotFile) (snapshotIndex, error) {
+	var index snapshotIndex
+	content, err := c.openChunk(decoder, key, snapshot.Index)
+
+	if err != nil {
+		return index, fmt.Errorf("Unable to read snapshot index: %w", err)
+	}
+
+	err = json.Unmarshal(content, &index)
+
+	if err != nil {
+		return index, fmt.Errorf("Unable to parse snapshot index: %w", err)
+	}
+
+	return index, nil
+}
+
+// Downloads a chunk and checks that its contents match its ID.
+func (c *config) readChunk(remote Remote, decoder *zstd.Decoder, key *repoKey, snapshotPath string, id string) ([]byte, error) {
+	var content bytes.Buffer
+	err := remote.Download(siblingPath(snapshotPath, CHUNK_PREFIX+id), &content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	chunk, err := c.openChunk(decoder, key, content.Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if chunkId(key, chunk) != id {
+		return nil, fmt.Errorf("Chunk %s is corrupted", id)
+	}
+
+	return chunk, nil
+}
+
+// Restores every file of a snapshot into destDir.
+func (c *config) restoreSnapshot(entry listEntry, destDir string) error {
+	remote, found := c.backends[entry.Remote]
+
+	if !found {
+		return fmt.Errorf("The remote \"%s\" does not exist in the configuration file", entry.Remote)
+	}
+
+	log.Printf("-- Restoring snapshot %s from remote %s\n", entry.Id, entry.Remote)
+
+	hash := sha256.New()
+	snapshot, err := c.loadSnapshot(remote, entry, hash)
+
+	if err != nil {
+		return fmt.Errorf("Error while downloading snapshot: %w", err)
+	}
+
+	if entry.Sha256 != "" && hex.EncodeToString(hash.Sum(nil)) != entry.Sha256 {
+		return fmt.Errorf("Checksum mismatch, the downloaded snapshot doesn't match the recorded SHA-256 checksum")
+	}
+
+	decoder, err := zstd.NewReader(nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer decoder.Close()
+
+	key, err := c.snapshotKey(remote, entry.FilePath, snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	index, err := c.readSnapshotIndex(decoder, key, snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(destDir, 0755)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create restore destination: %w", err)
+	}
+
+	log.Printf("Restoring %d files into %s", len(index.Files), destDir)
+
+	for _, file := range index.Files {
+		if file.Path == "." {
+			continue
+		}
+
+		target, err := safeJoin(destDir, file.Path)
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case file.Mode.IsDir():
+			err = os.MkdirAll(target, file.Mode.Perm()|0700)
+		case file.Mode&os.ModeSymlink != 0:
+			os.Remove(target)
+			err = os.Symlink(file.Link, target)
+		case file.Mode.IsRegular():
+			err = c.restoreChunkedFile(remote, decoder, key, entry.FilePath, file, target)
+		default:
+			log.Printf("Skipping unsupported file \"%s\"", file.Path)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to restore \"%s\": %w", file.Path, err)
+		}
+
+		if file.Mode&os.ModeSymlink == 0 {
+			modTime := time.Unix(0, file.ModTime)
+			os.Chtimes(target, modTime, modTime)
+		}
+	}
+
+	return nil
+}
+
+func (c *config) restoreChunkedFile(remote Remote, decoder *zstd.Decoder, key *repoKey, snapshotPath string, file snapshotEntry, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode.Perm())
+
+	if err != nil {
+		return err
+	}
+
+	defer output.Close()
+
+	for _, id := range file.Chunks {
+		chunk, err := c.readChunk(remote, decoder, key, snapshotPath, id)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = output.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return output.Close()
+}
+
+// Checks that every chunk of a snapshot can be read. If the repository key
+// can't be opened, only the existence of its chunks is checked.
+func (c *config) verifySnapshot(remote Remote, entry listEntry, hash io.Writer, result *verifyResult) error {
+	snapshot, err := c.loadSnapshot(remote, entry, hash)
+
+	if err != nil {
+		return err
+	}
+
+	key, err := c.snapshotKey(remote, entry.FilePath, snapshot)
+
+	if err != nil {
+		log.Printf("Not checking the contents of snapshot %s: %s", entry.Id, err)
+		result.contentsSkipped = true
+		return c.checkChunksExist(remote, snapshot, result)
+	}
+
+	decoder, err := zstd.NewReader(nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer decoder.Close()
+
+	index, err := c.readSnapshotIndex(decoder, key, snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	// Chunks shared by several files are only checked once.
+	readable := make(map[string]bool)
+
+	for _, file := range index.Files {
+		ok := true
+
+		for _, id := range file.Chunks {
+			if _, checked := readable[id]; !checked {
+				_, err := c.readChunk(remote, decoder, key, entry.FilePath, id)
+
+				if err != nil {
+					log.Printf("Unable to read chunk %s: %s", id, err)
+				}
+
+				readable[id] = err == nil
+			}
+
+			ok = ok && readable[id]
+		}
+
+		if !ok {
+			result.unreadable = append(result.unreadable, file.Path)
+			continue
+		}
+
+		result.files++
+	}
+
+	return nil
+}
+
+func (c *config) checkChunksExist(remote Remote, snapshot snapshotFile, result *verifyResult) error {
+	files, err := remote.List()
+
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[string]bool, len(files))
+
+	for _, file := range files {
+		stored[path.Base(file.Path)] = true
+	}
+
+	for _, id := range snapshot.Chunks {
+		if !stored[CHUNK_PREFIX+id] {
+			result.unreadable = append(result.unreadable, "chunk "+id)
+		}
+	}
+
+	return nil
+}
+
+// Deletes chunks which aren't used by any snapshot on the remotes that repo
+// backups are stored on. Only snapshot files still on the remote are taken
+// into account, so this has to run after old snapshots have been deleted.
+func (c *config) pruneChunks(dryRun bool) {
+	if !c.BackupList.Enabled || !c.BackupList.CleanEntries || !c.BackupList.DeleteRemote {
+		return
+	}
+
+	remoteNames := make(map[string]bool)
+
+	if c.Archive == ARCHIVE_REPO {
+		for _, target := range c.Targets {
+			remoteNames[target.Remote] = true
+		}
+	}
+
+	for _, entry := range c.BackupList.entries() {
+		if entry.Archive == ARCHIVE_REPO {
+			remoteNames[entry.Remote] = true
+		}
+	}
+
+	for remoteName := range remoteNames {
+		remote, found := c.backends[remoteName]
+
+		if !found {
+			continue
+		}
+
+		err := c.pruneRemoteChunks(remote, dryRun)
+
+		if err != nil {
+			log.Printf("Not deleting unused chunks from remote %s: %s", remoteName, err)
+		}
+	}
+}
+
+func (c *config) pruneRemoteChunks(remote Remote, dryRun bool) error {
+	if !dryRun {
+		lock, err := c.lockRepo(remote, REPO_LOCK_PRUNE, log.Default())
+
+		if err != nil {
+			return err
+		}
+
+		defer lock.unlock(log.Default())
+	}
+
+	files, err := remote.List()
+
+	if err != nil {
+		return err
+	}
+
+	// Its snapshot isn't on the remote yet, so the chunks it reuses look
+	// unused.
+	if hasRepoLock(files, REPO_LOCK_BACKUP) {
+		return fmt.Errorf("A backup to the repository is running on another machine")
+	}
+
+	used := make(map[string]bool)
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Path, "."+SNAPSHOT_EXT) {
+			continue
+		}
+
+		snapshot, err := c.loadSnapshot(remote, listEntry{FilePath: file.Path}, io.Discard)
+
+		// Deleting chunks of a snapshot that couldn't be read would break it.
+		if err != nil {
+			return fmt.Errorf("Unable to read snapshot %s: %w", file.Path, err)
+		}
+
+		for _, id := range snapshot.Chunks {
+			used[id] = true
+		}
+	}
+
+	var deleted int
+	var freed int64
+
+	for _, file := range files {
+		name := path.Base(file.Path)
+
+		if !strings.HasPrefix(name, CHUNK_PREFIX) || used[strings.TrimPrefix(name, CHUNK_PREFIX)] {
+			continue
+		}
+
+		if time.Since(file.ModTime) < CHUNK_GRACE_PERIOD {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would delete unused chunk %s\n", file.Path)
+			continue
+		}
+
+		err = remote.Delete(file.Path)
+
+		if err != nil {
+			log.Printf("Unable to delete chunk %s: %s", file.Path, err)
+			continue
+		}
+
+		deleted++
+		freed += file.Size
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d unused chunks, freeing %.1f MiB", deleted, float64(freed)/MEBIBYTE)
+	}
+
+	return nil
+}
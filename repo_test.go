@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Returns: Every chunk of input, Error
+func chunkAll(input io.Reader) ([][]byte, error) {
+	c := newChunker(input)
+	var chunks [][]byte
+
+	for {
+		chunk, err := c.next()
+
+		if err == io.EOF {
+			return chunks, nil
+		}
+
+		if err != nil {
+			return chunks, err
+		}
+
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	random := make([]byte, 12*MEBIBYTE)
+	rand.NewChaCha8([32]byte{}).Read(random)
+
+	tests := []struct {
+		name  string
+		input []byte
+		// Read in small pieces, which must not move the boundaries
+		halfReads  bool
+		wantChunks int
+	}{
+		{"empty", nil, false, 0},
+		{"one byte", []byte{1}, false, 1},
+		{"smaller than the minimum", random[:MIN_CHUNK_SIZE], false, 1},
+		{"zeros", make([]byte, 3*MAX_CHUNK_SIZE), false, 3},
+		{"random", random, false, -1},
+		{"random in small reads", random, true, -1},
+	}
+
+	want, _ := chunkAll(bytes.NewReader(random))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var input io.Reader = bytes.NewReader(test.input)
+
+			if test.halfReads {
+				input = iotest.HalfReader(input)
+			}
+
+			chunks, err := chunkAll(input)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.wantChunks >= 0 && len(chunks) != test.wantChunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), test.wantChunks)
+			}
+
+			for i, chunk := range chunks {
+				if len(chunk) > MAX_CHUNK_SIZE || (i < len(chunks)-1 && len(chunk) <= MIN_CHUNK_SIZE) {
+					t.Errorf("chunk %d has %d bytes", i, len(chunk))
+				}
+			}
+
+			if !bytes.Equal(bytes.Join(chunks, nil), test.input) {
+				t.Error("the chunks don't add up to the input")
+			}
+
+			if test.halfReads && !slices.EqualFunc(chunks, want, bytes.Equal) {
+				t.Error("the boundaries depend on how the input is read")
+			}
+		})
+	}
+}
+
+// Inserting data at the start of a file only changes the first chunk, so the
+// rest are reused.
+func TestChunkerInsertion(t *testing.T) {
+	random := make([]byte, 12*MEBIBYTE)
+	rand.NewChaCha8([32]byte{}).Read(random)
+
+	before, _ := chunkAll(bytes.NewReader(random))
+	after, _ := chunkAll(bytes.NewReader(append([]byte("inserted"), random...)))
+
+	if len(before) < 3 || len(after) != len(before) {
+		t.Fatalf("got %d chunks before and %d after the insertion", len(before), len(after))
+	}
+
+	if !slices.EqualFunc(before[1:], after[1:], bytes.Equal) {
+		t.Error("chunks after the first one changed")
+	}
+}
+
+func TestChunkerReadError(t *testing.T) {
+	readErr := errors.New("disk is gone")
+
+	if _, err := chunkAll(iotest.ErrReader(readErr)); !errors.Is(err, readErr) {
+		t.Errorf("chunkAll() error = %v, want %v", err, readErr)
+	}
+}
+
+func TestSealChunkRoundTrip(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer encoder.Close()
+
+	decoder, err := zstd.NewReader(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer decoder.Close()
+
+	key, err := newRepoKey(bytes.Repeat([]byte{7}, REPO_KEY_SIZE))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := make([]byte, 100_000)
+	rand.NewChaCha8([32]byte{}).Read(random)
+
+	inputs := map[string][]byte{
+		"text":   bytes.Repeat([]byte("level.dat "), 1000),
+		"random": random,
+		// The first chunk of a .zst file starts with the zstd magic number.
+		"zstd frame": encoder.EncodeAll(random, nil),
+		"one byte":   {0x28},
+	}
+
+	for _, compression := range []string{"none", "zstd"} {
+		for _, encrypted := range []bool{false, true} {
+			for name, input := range inputs {
+				c := &config{Compression: compression}
+				chunkKey := key
+
+				if !encrypted {
+					chunkKey = nil
+				}
+
+				sealed := c.sealChunk(encoder, chunkKey, input)
+				opened, err := c.openChunk(decoder, chunkKey, sealed)
+
+				if err != nil {
+					t.Errorf("compression %s, encrypted %v, %s: openChunk() error = %v", compression, encrypted, name, err)
+					continue
+				}
+
+				if !bytes.Equal(opened, input) {
+					t.Errorf("compression %s, encrypted %v, %s: openChunk(sealChunk(x)) != x", compression, encrypted, name)
+				}
+			}
+		}
+	}
+}
+
+// Chunks are shared between backups, which may have been made with another
+// compression option.
+func TestOpenChunkAfterCompressionChange(t *testing.T) {
+	encoder, _ := zstd.NewWriter(nil)
+	defer encoder.Close()
+	decoder, _ := zstd.NewReader(nil)
+	defer decoder.Close()
+
+	input := encoder.EncodeAll([]byte("region file"), nil)
+	sealed := (&config{Compression: "zstd"}).sealChunk(encoder, nil, input)
+	opened, err := (&config{Compression: "none"}).openChunk(decoder, nil, sealed)
+
+	if err != nil || !bytes.Equal(opened, input) {
+		t.Errorf("openChunk() = %v, %v, want the sealed input", opened, err)
+	}
+}
+
+func TestPruneRemoteChunks(t *testing.T) {
+	old := time.Now().Add(-2 * CHUNK_GRACE_PERIOD)
+
+	tests := []struct {
+		name    string
+		lock    string
+		lockAge time.Time
+		wantErr bool
+		want    []string
+	}{
+		{"unused old chunk", "", time.Time{}, false, []string{"a.snapshot", "chunk-new", "chunk-used"}},
+		{"backup running elsewhere", "lock-backup-x", time.Now(), true, []string{"a.snapshot", "chunk-new", "chunk-old", "chunk-used", "lock-backup-x"}},
+		{"stale backup lock", "lock-backup-x", old, false, []string{"a.snapshot", "chunk-new", "chunk-used", "lock-backup-x"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			snapshot, _ := json.Marshal(snapshotFile{Version: SNAPSHOT_VERSION, Chunks: []string{"used"}})
+			files := map[string][]byte{"a.snapshot": snapshot, "chunk-used": {1}, "chunk-old": {2}, "chunk-new": {3}}
+
+			if test.lock != "" {
+				files[test.lock] = nil
+			}
+
+			for name, content := range files {
+				filePath := filepath.Join(dir, name)
+				os.WriteFile(filePath, content, FILE_MODE)
+
+				switch {
+				case name == test.lock:
+					os.Chtimes(filePath, test.lockAge, test.lockAge)
+				case name != "chunk-new":
+					os.Chtimes(filePath, old, old)
+				}
+			}
+
+			remote, err := newLocalRemote("usb", remote{Root: dir})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = (&config{}).pruneRemoteChunks(remote, false)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("pruneRemoteChunks() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			entries, _ := os.ReadDir(dir)
+			var left []string
+
+			for _, entry := range entries {
+				left = append(left, entry.Name())
+			}
+
+			if !slices.Equal(left, test.want) {
+				t.Errorf("files left = %v, want %v", left, test.want)
+			}
+		})
+	}
+}
+
+func TestHasRepoLock(t *testing.T) {
+	files := []remoteFile{
+		{Path: "https://dav.example.com/backups/lock-prune-abc", ModTime: time.Now()},
+		{Path: "https://dav.example.com/backups/lock-backup-old", ModTime: time.Now().Add(-REPO_LOCK_STALE_AGE - time.Minute)},
+		{Path: "https://dav.example.com/backups/chunk-lock-backup-x", ModTime: time.Now()},
+	}
+
+	if !hasRepoLock(files, REPO_LOCK_PRUNE) {
+		t.Error("hasRepoLock() missed the prune lock")
+	}
+
+	if hasRepoLock(files, REPO_LOCK_BACKUP) {
+		t.Error("hasRepoLock() reported a stale or unrelated file as a backup lock")
+	}
+}
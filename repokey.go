@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Prefix of the names of repository key files, followed by the key's ID
+const REPO_KEY_PREFIX = "repo-key-"
+
+// Directory next to the backup list with the keys this machine created, so
+// machines that only have the public keys can keep using them
+const REPO_KEY_CACHE_DIR = "repokeys"
+
+const REPO_KEY_SIZE = 32
+
+// The secret of an encrypted repository. Chunks and snapshot indexes are
+// encrypted with it instead of with age, which would run scrypt for every
+// chunk when a passphrase is used. The secret itself is stored on the remote
+// as an age file.
+type repoKey struct {
+	id   string
+	aead cipher.AEAD
+
+	// HMAC key for chunk IDs, so they don't reveal the checksums of files
+	idKey []byte
+}
+
+func newRepoKey(secret []byte) (*repoKey, error) {
+	if len(secret) != REPO_KEY_SIZE {
+		return nil, fmt.Errorf("Repository keys must be %d bytes long", REPO_KEY_SIZE)
+	}
+
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+
+	aead, err := chacha20poly1305.NewX(derive("qbsgo chunk encryption"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &repoKey{
+		id:    hex.EncodeToString(derive("qbsgo key id")[:16]),
+		aead:  aead,
+		idKey: derive("qbsgo chunk id"),
+	}, nil
+}
+
+func (k *repoKey) seal(data []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	rand.Read(nonce)
+
+	return k.aead.Seal(nonce, nonce, data, nil)
+}
+
+func (k *repoKey) open(data []byte) ([]byte, error) {
+	if len(data) < k.aead.NonceSize() {
+		return nil, errors.New("Encrypted data is too short")
+	}
+
+	nonce := data[:k.aead.NonceSize()]
+	return k.aead.Open(nil, nonce, data[len(nonce):], nil)
+}
+
+// Returns the ID of a chunk, which is the SHA-256 of its contents, or their
+// HMAC if the repository is encrypted.
+func chunkId(key *repoKey, chunk []byte) string {
+	if key == nil {
+		sum := sha256.Sum256(chunk)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, key.idKey)
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the key that new chunks on the remote are encrypted with. An
+// existing key is used if it can be opened, otherwise a new one is created.
+// files are the files on the remote.
+func (c *config) repoKeyFor(remoteName string, remote Remote, files []remoteFile, logger *log.Logger) (*repoKey, error) {
+	c.repoKeyLock.Lock()
+	defer c.repoKeyLock.Unlock()
+
+	// Targets backed up at the same time use the same key.
+	if key, found := c.remoteKeys[remoteName]; found {
+		return key, nil
+	}
+
+	var keyPaths []string
+
+	for _, file := range files {
+		if strings.HasPrefix(path.Base(file.Path), REPO_KEY_PREFIX) {
+			keyPaths = append(keyPaths, file.Path)
+		}
+	}
+
+	slices.Sort(keyPaths)
+
+	for _, keyPath := range keyPaths {
+		key, err := c.openRepoKey(remote, keyPath)
+
+		if err == nil {
+			c.remoteKeys[remoteName] = key
+			return key, nil
+		}
+
+		logger.Printf("Unable to open the repository key %s: %s", keyPath, err)
+	}
+
+	key, err := c.createRepoKey(remote, logger)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create a repository key: %w", err)
+	}
+
+	c.remoteKeys[remoteName] = key
+	return key, nil
+}
+
+// Returns the key a snapshot is encrypted with, nil if it isn't encrypted.
+func (c *config) snapshotKey(remote Remote, snapshotPath string, snapshot snapshotFile) (*repoKey, error) {
+	if snapshot.Key == "" {
+		return nil, nil
+	}
+
+	c.repoKeyLock.Lock()
+	defer c.repoKeyLock.Unlock()
+
+	key, err := c.openRepoKey(remote, siblingPath(snapshotPath, REPO_KEY_PREFIX+snapshot.Key))
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the repository key %s: %w", snapshot.Key, err)
+	}
+
+	return key, nil
+}
+
+// Reads a key from the cache of keys created on this machine, or downloads
+// and decrypts it. The caller must hold repoKeyLock.
+func (c *config) openRepoKey(remote Remote, keyPath string) (*repoKey, error) {
+	id := strings.TrimPrefix(path.Base(keyPath), REPO_KEY_PREFIX)
+
+	if key, found := c.repoKeys[id]; found {
+		return key, nil
+	}
+
+	secret, err := os.ReadFile(path.Join(AppFileDir, REPO_KEY_CACHE_DIR, id))
+
+	if err != nil {
+		var content bytes.Buffer
+
+		if err = remote.Download(keyPath, &content); err != nil {
+			return nil, err
+		}
+
+		decrypted, err := c.decrypt(&content)
+
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err = io.ReadAll(io.LimitReader(decrypted, REPO_KEY_SIZE+1))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := newRepoKey(secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key.id != id {
+		return nil, errors.New("The key doesn't match its ID")
+	}
+
+	c.repoKeys[id] = key
+	return key, nil
+}
+
+// Creates a random key, saves it to the cache and uploads it encrypted to the
+// recipients of the encryption section. The caller must hold repoKeyLock.
+func (c *config) createRepoKey(remote Remote, logger *log.Logger) (*repoKey, error) {
+	secret := make([]byte, REPO_KEY_SIZE)
+	rand.Read(secret)
+
+	key, err := newRepoKey(secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted bytes.Buffer
+	writer, err := c.encrypt(&encrypted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = writer.Write(secret); err != nil {
+		return nil, err
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	cacheDir := path.Join(AppFileDir, REPO_KEY_CACHE_DIR)
+	err = os.MkdirAll(cacheDir, 0700)
+
+	if err == nil {
+		err = os.WriteFile(path.Join(cacheDir, key.id), secret, 0600)
+	}
+
+	// Without the cache, machines that can't decrypt the uploaded key create
+	// a new one on every run, which only costs deduplication.
+	if err != nil {
+		logger.Printf("Unable to save the repository key to %s: %s", cacheDir, err)
+	}
+
+	_, err = c.uploadBytes(remote, encrypted.Bytes(), REPO_KEY_PREFIX+key.id, logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Created repository key %s", key.id)
+
+	c.repoKeys[key.id] = key
+	return key, nil
+}
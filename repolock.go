@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nrednav/cuid2"
+)
+
+// Prefix of the lock files of the backups and prunes running on a repository,
+// followed by REPO_LOCK_BACKUP or REPO_LOCK_PRUNE and a random ID
+const REPO_LOCK_PREFIX = "lock-"
+
+const (
+	REPO_LOCK_BACKUP = "backup"
+	REPO_LOCK_PRUNE  = "prune"
+)
+
+// Locks left behind by runs that were stopped are ignored after this long
+const REPO_LOCK_STALE_AGE = CHUNK_GRACE_PERIOD
+
+// How often a backup checks whether a prune on another machine has finished
+const REPO_LOCK_RETRY_INTERVAL = time.Minute
+
+// A lock file on a repository's remote. Machines sharing a repository use
+// them so a prune doesn't delete old chunks that a running backup reuses.
+// Both write their lock before listing the remote, so at least one of them
+// sees the other's lock.
+type repoLock struct {
+	remote   Remote
+	filePath string
+}
+
+// Uploads a lock file of the given kind, containing the host name.
+func (c *config) lockRepo(remote Remote, kind string, logger *log.Logger) (*repoLock, error) {
+	hostname, _ := os.Hostname()
+	filePath, err := c.uploadBytes(remote, []byte(hostname), REPO_LOCK_PREFIX+kind+"-"+cuid2.Generate(), logger)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock the repository: %w", err)
+	}
+
+	return &repoLock{remote: remote, filePath: filePath}, nil
+}
+
+// Deletes the lock file. Errors are only logged, since the lock is ignored
+// once it is stale.
+func (l *repoLock) unlock(logger *log.Logger) {
+	if err := l.remote.Delete(l.filePath); err != nil {
+		logger.Printf("Unable to delete the repository lock %s: %s", l.filePath, err)
+	}
+}
+
+// Returns: Whether files has a lock of the given kind which isn't stale
+func hasRepoLock(files []remoteFile, kind string) bool {
+	for _, file := range files {
+		if strings.HasPrefix(path.Base(file.Path), REPO_LOCK_PREFIX+kind+"-") && time.Since(file.ModTime) < REPO_LOCK_STALE_AGE {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lists the files on a repository's remote once no prune is running on
+// another machine. The caller must hold a backup lock.
+func listRepo(remote Remote, logger *log.Logger) ([]remoteFile, error) {
+	for {
+		files, err := remote.List()
+
+		if err != nil || !hasRepoLock(files, REPO_LOCK_PRUNE) {
+			return files, err
+		}
+
+		logger.Printf("Unused chunks are being pruned by another machine, checking again in %s", REPO_LOCK_RETRY_INTERVAL)
+		time.Sleep(REPO_LOCK_RETRY_INTERVAL)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func (c *config) restore(id string, destDir string, force bool) {
+	entry, found := c.BackupList.find(id)
+
+	if !found {
+		log.Fatalf("No backup with the ID \"%s\" was found in the backup list", id)
+	}
+
+	if destDir == "" {
+		log.Fatalln("No restore destination specified. Please specify it through the -restoreTo flag.")
+	}
+
+	empty, err := isEmptyDir(destDir)
+
+	if err != nil {
+		log.Fatalf("Unable to check the restore destination: %s", err)
+	}
+
+	if !empty && !force {
+		log.Fatalf("The directory %s is not empty. Use the -force flag to extract into it anyway.", destDir)
+	}
+
+	chain, err := c.BackupList.restoreChain(entry)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if len(chain) > 1 {
+		log.Printf("Backup %s is incremental, restoring %d backups starting from full backup %s", entry.Id, len(chain), chain[0].Id)
+	}
+
+	for _, link := range chain {
+		err = c.restoreArchive(link, destDir)
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	log.Printf("Backup %s restored to %s\n", entry.Id, destDir)
+}
+
+// Downloads, decrypts and extracts the archive of a single backup.
+func (c *config) restoreArchive(entry listEntry, destDir string) error {
+	if entry.Archive == ARCHIVE_REPO {
+		return c.restoreSnapshot(entry, destDir)
+	}
+
+	// The archive kept in ArchiveDir has the same name, and the archive on a
+	// local remote may be a hard link to it, so it mustn't be overwritten.
+	tempDir, err := os.MkdirTemp(c.ArchiveDir, ".restore-")
+
+	if err != nil {
+		return fmt.Errorf("Unable to create a directory for the download: %w", err)
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	fileName := path.Base(entry.FilePath)
+	archivePath := path.Join(tempDir, fileName)
+
+	log.Printf("-- Restoring backup %s from remote %s\n", entry.Id, entry.Remote)
+	log.Printf("Downloading %s to %s", entry.FilePath, archivePath)
+
+	err = c.download(entry, archivePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while downloading backup: %w", err)
+	}
+
+	if strings.HasSuffix(archivePath, ENCRYPTED_SUFFIX) {
+		encryptedPath := archivePath
+		archivePath = strings.TrimSuffix(archivePath, ENCRYPTED_SUFFIX)
+		fileName = path.Base(archivePath)
+
+		log.Printf("Decrypting %s", encryptedPath)
+
+		err = c.decryptFile(encryptedPath, archivePath)
+		os.Remove(encryptedPath)
+
+		if err != nil {
+			return fmt.Errorf("Error while decrypting backup: %w", err)
+		}
+	}
+
+	log.Printf("Extracting %s into %s", fileName, destDir)
+
+	err = extractArchive(archivePath, destDir)
+
+	if err != nil {
+		return fmt.Errorf("Error while extracting backup: %w", err)
+	}
+
+	return nil
+}
+
+// Downloads the file of a backup list entry into outPath.
+func (c *config) download(entry listEntry, outPath string) error {
+	remote, found := c.backends[entry.Remote]
+
+	if !found {
+		return fmt.Errorf("The remote \"%s\" does not exist in the configuration file", entry.Remote)
+	}
+
+	file, err := os.Create(outPath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create output file %w", err)
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	err = remote.Download(entry.FilePath, io.MultiWriter(file, hash))
+
+	if err != nil {
+		return err
+	}
+
+	if entry.Sha256 != "" {
+		checksum := hex.EncodeToString(hash.Sum(nil))
+
+		if checksum != entry.Sha256 {
+			return fmt.Errorf("Checksum mismatch, the downloaded file has SHA-256 %s but the backup list has %s", checksum, entry.Sha256)
+		}
+
+		log.Println("Downloaded file matches the recorded SHA-256 checksum")
+	}
+
+	return file.Sync()
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) == 0, nil
+}
+
+// Detects the archive format from the file extension produced by config.backup
+// and extracts the archive into destDir.
+func extractArchive(archivePath string, destDir string) error {
+	err := os.MkdirAll(destDir, 0755)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create restore destination: %w", err)
+	}
+
+	if strings.HasSuffix(archivePath, ".zip") {
+		return extractZip(archivePath, destDir)
+	}
+
+	file, err := os.Open(archivePath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to open archive: %w", err)
+	}
+
+	defer file.Close()
+
+	reader, err := decompressTar(archivePath, file)
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+	return extractTar(reader, destDir)
+}
+
+// Wraps input with the decompressor matching the extension of a tar archive's
+// file name.
+func decompressTar(fileName string, input io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(fileName, ".tar"):
+		return io.NopCloser(input), nil
+	case strings.HasSuffix(fileName, ".tar.gz"):
+		return gzip.NewReader(input)
+	case strings.HasSuffix(fileName, ".tar.zst"):
+		reader, err := zstd.NewReader(input)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return reader.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("Unrecognized archive format for file \"%s\"", path.Base(fileName))
+}
+
+// Joins name onto destDir, refusing names that would escape destDir, either
+// lexically or through a symlink restored earlier. A symlink at the target
+// itself is removed, since the entry replaces it and writing through it would
+// also escape destDir.
+func safeJoin(destDir string, name string) (string, error) {
+	target := filepath.Join(destDir, filepath.FromSlash(name))
+	relPath, err := filepath.Rel(destDir, target)
+
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Archive entry \"%s\" points outside of the destination", name)
+	}
+
+	if relPath == "." {
+		return target, nil
+	}
+
+	current := destDir
+	components := strings.Split(relPath, string(filepath.Separator))
+
+	for i, component := range components {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("Unable to check \"%s\": %w", current, err)
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if i < len(components)-1 {
+			return "", fmt.Errorf("Archive entry \"%s\" is inside of the symlink \"%s\"", name, current)
+		}
+
+		err = os.Remove(current)
+
+		if err != nil {
+			return "", fmt.Errorf("Unable to replace the symlink \"%s\": %w", current, err)
+		}
+	}
+
+	return target, nil
+}
+
+func extractTar(input io.Reader, destDir string) error {
+	tarReader := tar.NewReader(input)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to read tar header: %w", err)
+		}
+
+		if header.Name == DELETED_LIST_NAME {
+			err = applyDeletedList(destDir, tarReader)
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		target, err := safeJoin(destDir, header.Name)
+
+		if err != nil {
+			return err
+		}
+
+		mode := header.FileInfo().Mode()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode.Perm()|0700)
+		case tar.TypeReg:
+			err = writeFile(target, tarReader, mode.Perm())
+		case tar.TypeSymlink:
+			os.Remove(target)
+			err = os.Symlink(header.Linkname, target)
+		default:
+			log.Printf("Skipping unsupported tar entry \"%s\"", header.Name)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to extract \"%s\": %w", header.Name, err)
+		}
+
+		if header.Typeflag != tar.TypeSymlink {
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		}
+	}
+}
+
+func extractZip(archivePath string, destDir string) error {
+	zipReader, err := zip.OpenReader(archivePath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to open zip archive: %w", err)
+	}
+
+	defer zipReader.Close()
+
+	for _, file := range zipReader.File {
+		if file.Name == DELETED_LIST_NAME {
+			err = applyZipDeletedList(destDir, file)
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		target, err := safeJoin(destDir, file.Name)
+
+		if err != nil {
+			return err
+		}
+
+		mode := file.Mode()
+
+		if mode.IsDir() {
+			err = os.MkdirAll(target, mode.Perm()|0700)
+		} else {
+			err = extractZipFile(file, target)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to extract \"%s\": %w", file.Name, err)
+		}
+
+		os.Chtimes(target, file.Modified, file.Modified)
+	}
+
+	return nil
+}
+
+func extractZipFile(file *zip.File, target string) error {
+	reader, err := file.Open()
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	return writeFile(target, reader, file.Mode().Perm())
+}
+
+func applyZipDeletedList(destDir string, file *zip.File) error {
+	reader, err := file.Open()
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	return applyDeletedList(destDir, reader)
+}
+
+func writeFile(target string, input io.Reader, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, input)
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a gzipped tar archive with a file for each name, containing the
+// name itself.
+func testTarGz(t *testing.T, names ...string) []byte {
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, name := range names {
+		err := tarWriter.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name))})
+
+		if err == nil {
+			_, err = tarWriter.Write([]byte(name))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tarWriter.Close()
+	gzipWriter.Close()
+	return archive.Bytes()
+}
+
+func TestRestoreKeepsLocalArchive(t *testing.T) {
+	archiveDir := t.TempDir()
+	fileName := "world-2025-01-01-abc.tar.gz"
+	archivePath := filepath.Join(archiveDir, fileName)
+	content := testTarGz(t, "level.dat", "region/r.0.0.mca")
+
+	if err := os.WriteFile(archivePath, content, FILE_MODE); err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := newLocalRemote("usb", remote{Root: t.TempDir()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hard links the archive into the remote when deleteAfterUpload is off.
+	remotePath, err := remote.Upload(archivePath, fileName, log.New(io.Discard, "", 0))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	entry := listEntry{Id: "abc", Remote: "usb", FilePath: remotePath, Sha256: hex.EncodeToString(sum[:]), Status: STATUS_OK}
+	c := &config{ArchiveDir: archiveDir, backends: map[string]Remote{"usb": remote}}
+	c.DeleteAfterUpload = false
+	destDir := t.TempDir()
+
+	if err = c.restoreArchive(entry, destDir); err != nil {
+		t.Fatalf("restoreArchive() error = %v", err)
+	}
+
+	for _, name := range []string{"level.dat", "region/r.0.0.mca"} {
+		restored, err := os.ReadFile(filepath.Join(destDir, name))
+
+		if err != nil || string(restored) != name {
+			t.Errorf("restored %s = %q, %v", name, restored, err)
+		}
+	}
+
+	for _, filePath := range []string{archivePath, remotePath} {
+		kept, err := os.ReadFile(filePath)
+
+		if err != nil || !bytes.Equal(kept, content) {
+			t.Errorf("%s was changed by the restore: %v", filePath, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(archiveDir)
+
+	if len(entries) != 1 {
+		t.Errorf("ArchiveDir has %d files after the restore, want only the kept archive", len(entries))
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	destDir := t.TempDir()
+	outside := t.TempDir()
+
+	os.Mkdir(filepath.Join(destDir, "world"), 0755)
+	os.Symlink(outside, filepath.Join(destDir, "escape"))
+	os.Symlink("world", filepath.Join(destDir, "inside"))
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"level.dat", "level.dat", false},
+		{"world/region/r.0.0.mca", "world/region/r.0.0.mca", false},
+		{"world/../level.dat", "level.dat", false},
+		{".", ".", false},
+		{"../level.dat", "", true},
+		{"world/../../level.dat", "", true},
+		{"/etc/passwd", "etc/passwd", false},
+		{"escape/level.dat", "", true},
+		// Even symlinks pointing into destDir are refused as parents, since
+		// an entry after them could change where they point.
+		{"inside/level.dat", "", true},
+		// A symlink at the target itself is replaced by the entry.
+		{"escape", "escape", false},
+	}
+
+	for _, test := range tests {
+		got, err := safeJoin(destDir, test.name)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("safeJoin(%q) error = %v, wantErr %v", test.name, err, test.wantErr)
+			continue
+		}
+
+		if !test.wantErr && got != filepath.Join(destDir, test.want) {
+			t.Errorf("safeJoin(%q) = %q, want %q", test.name, got, filepath.Join(destDir, test.want))
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(destDir, "escape")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("the symlink at the target wasn't removed")
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("the symlink's target was removed: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+)
+
+// Directory next to the backup list with the state of unfinished uploads
+const UPLOAD_STATE_DIR = "uploads"
+
+// Progress of an upload, saved after every chunk so a later run can finish
+// the upload if QBS is stopped.
+type uploadState struct {
+	// The backup which is recorded in the backup list once the upload is
+	// done
+	Entry listEntry
+
+	ArchivePath string
+	FileName    string
+	Size        int64
+
+	// Hex encoded SHA-256 of the archive
+	Sha256 string
+
+	// Nextcloud's folder of uploaded chunks, and their size
+	ChunksFolder string
+	ChunkSize    int64
+
+	// Number of the last chunk which was uploaded along with every chunk
+	// before it
+	LastChunk int
+
+	// Chunks that finished uploading after LastChunk, since they can be
+	// uploaded out of order
+	confirmed map[int]bool
+
+	filePath string
+	lock     *flock.Flock
+}
+
+func uploadStatePath(fileName string) string {
+	return path.Join(AppFileDir, UPLOAD_STATE_DIR, fileName+".json")
+}
+
+// Locks the upload state at statePath, so other runs of QBS don't try to
+// resume it while it's being uploaded. The saved state is continued if it is
+// for the same archive, otherwise a new one is created.
+func newUploadState(statePath string, entry listEntry, archivePath string, fileName string) (*uploadState, error) {
+	state := &uploadState{
+		Entry:       entry,
+		ArchivePath: archivePath,
+		FileName:    fileName,
+		Size:        entry.Size,
+		Sha256:      entry.Sha256,
+		filePath:    statePath,
+	}
+
+	err := os.MkdirAll(path.Dir(state.filePath), 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	state.lock = flock.New(state.filePath + ".lock")
+
+	if err = state.lock.Lock(); err != nil {
+		return nil, err
+	}
+
+	var saved uploadState
+
+	if content, err := os.ReadFile(state.filePath); err == nil && json.Unmarshal(content, &saved) == nil &&
+		saved.Size == state.Size && saved.Sha256 == state.Sha256 {
+		state.ChunksFolder = saved.ChunksFolder
+		state.ChunkSize = saved.ChunkSize
+		state.LastChunk = saved.LastChunk
+	}
+
+	if err = state.save(); err != nil {
+		state.remove()
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Loads the state of every unfinished upload that isn't being uploaded by
+// another run of QBS. The returned states are locked.
+func loadUploadStates() ([]*uploadState, error) {
+	files, err := filepath.Glob(path.Join(AppFileDir, UPLOAD_STATE_DIR, "*.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*uploadState
+
+	for _, filePath := range files {
+		lock := flock.New(filePath + ".lock")
+		locked, err := lock.TryLock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !locked {
+			continue
+		}
+
+		content, err := os.ReadFile(filePath)
+
+		// Finished by another run after the file was listed.
+		if errors.Is(err, fs.ErrNotExist) {
+			lock.Unlock()
+			continue
+		}
+
+		state := &uploadState{filePath: filePath, lock: lock}
+
+		if err == nil {
+			err = json.Unmarshal(content, state)
+		}
+
+		if err != nil {
+			log.Printf("Unable to read the upload state %s: %s", filePath, err)
+			state.remove()
+			continue
+		}
+
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+func (s *uploadState) save() error {
+	content, err := json.Marshal(s)
+
+	if err != nil {
+		return err
+	}
+
+	// Replaces the old state in one step, so it's never half written.
+	tempPath := s.filePath + PARTIAL_SUFFIX
+	err = os.WriteFile(tempPath, content, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, s.filePath)
+}
+
+// Records that a chunk has been uploaded. Errors are only logged, since the
+// upload can still finish without the state.
+func (s *uploadState) confirm(chunkNum int, logger *log.Logger) {
+	if s.confirmed == nil {
+		s.confirmed = make(map[int]bool)
+	}
+
+	s.confirmed[chunkNum] = true
+
+	if !s.confirmed[s.LastChunk+1] {
+		return
+	}
+
+	for s.confirmed[s.LastChunk+1] {
+		delete(s.confirmed, s.LastChunk+1)
+		s.LastChunk++
+	}
+
+	if err := s.save(); err != nil {
+		logger.Printf("Unable to save the upload state: %s", err)
+	}
+}
+
+// Deletes the state once the upload is over, and unlocks it.
+func (s *uploadState) remove() {
+	os.Remove(s.filePath)
+	os.Remove(s.lock.Path())
+	s.lock.Unlock()
+}
+
+// Uploads an archive which was saved to disk, saving the progress to
+// statePath so it can be resumed if QBS is stopped during the upload or the
+// upload fails. entry is the backup which is recorded in the backup list if
+// the upload is resumed.
+//
+// Returns: Destination path, Error
+func uploadResumable(remote resumableRemote, outPath string, fileName string, statePath string, entry listEntry, logger *log.Logger) (string, error) {
+	state, err := newUploadState(statePath, entry, outPath, fileName)
+
+	if err != nil {
+		return "", fmt.Errorf("Unable to save the upload state: %w", err)
+	}
+
+	filePath, err := remote.UploadResumable(outPath, fileName, state, logger)
+
+	if err != nil {
+		// Kept so the upload continues where it stopped. The state is moved
+		// along with the archive when the archive is spooled, otherwise the
+		// next run resumes it.
+		state.lock.Unlock()
+		return filePath, err
+	}
+
+	state.remove()
+	return filePath, nil
+}
+
+// Finishes the uploads that were interrupted by QBS being stopped, and
+// records their backups in the backup list. Uploads that fail again are
+// tried again on the next run.
+func (c *config) resumeUploads() {
+	states, err := loadUploadStates()
+
+	if err != nil {
+		log.Printf("Unable to load unfinished uploads: %s", err)
+		return
+	}
+
+	for _, state := range states {
+		c.resumeUpload(state)
+	}
+}
+
+func (c *config) resumeUpload(state *uploadState) {
+	entry := state.Entry
+	logger := targetLogger(entry.Target)
+	remote, ok := c.backends[entry.Remote].(resumableRemote)
+
+	if !ok {
+		logger.Printf("Dropping the unfinished upload of %s, the remote \"%s\" can't resume uploads", state.FileName, entry.Remote)
+		state.remove()
+		return
+	}
+
+	info, err := os.Stat(state.ArchivePath)
+
+	if err != nil || info.Size() != state.Size {
+		logger.Printf("Dropping the unfinished upload of %s, the archive %s is gone or has changed", state.FileName, state.ArchivePath)
+		state.remove()
+		return
+	}
+
+	logger.Printf("-- Resuming the upload of backup %s of target %s\n", entry.Id, entry.Target)
+
+	entry.FilePath, err = remote.UploadResumable(state.ArchivePath, state.FileName, state, logger)
+
+	if err != nil {
+		logger.Printf("Error while resuming the upload of %s, trying again on the next run: %s", state.FileName, err)
+		state.lock.Unlock()
+		return
+	}
+
+	entry.Status = STATUS_OK
+	c.BackupList.record(entry, logger)
+	state.remove()
+
+	if c.DeleteAfterUpload {
+		logger.Printf("Deleting %s...", state.ArchivePath)
+
+		if err = os.Remove(state.ArchivePath); err != nil {
+			logger.Printf("Error while deleting backup file: %s", err)
+		}
+	}
+}
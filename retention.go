@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The outcome of the retention rules for a single backup list entry.
+type retentionDecision struct {
+	entry  listEntry
+	target string
+	keep   bool
+	reason string
+}
+
+func (r retention) isSet() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 || r.KeepMonthly > 0 || r.KeepYearly > 0
+}
+
+// A single keep-* rule. Entries are kept if they are the newest entry of a
+// period that hasn't been kept yet, until count periods have been kept.
+type retentionRule struct {
+	name   string
+	count  int
+	period func(date time.Time) string
+}
+
+func (r retention) rules() []retentionRule {
+	return []retentionRule{
+		{"last", r.KeepLast, func(date time.Time) string { return date.String() }},
+		{"daily", r.KeepDaily, func(date time.Time) string { return date.Format(time.DateOnly) }},
+		{"weekly", r.KeepWeekly, func(date time.Time) string {
+			year, week := date.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", r.KeepMonthly, func(date time.Time) string { return date.Format("2006-01") }},
+		{"yearly", r.KeepYearly, func(date time.Time) string { return date.Format("2006") }},
+	}
+}
+
+// Decides which entries of a single target to keep. Entries that can't be
+// dated are always kept, and so are spooled backups, which haven't been
+// uploaded yet. Failed, deferred and skipped backups don't count towards any
+// rule and are kept until there is a newer successful backup.
+func (r retention) apply(targetName string, entries []listEntry) []retentionDecision {
+	type datedEntry struct {
+		index int
+		date  time.Time
+	}
+
+	decisions := make([]retentionDecision, len(entries))
+	var dated []datedEntry
+	var failed []datedEntry
+	var newestSuccess time.Time
+
+	for i, entry := range entries {
+		decisions[i] = retentionDecision{entry: entry, target: targetName}
+		date, err := time.Parse(time.RFC3339, entry.Date)
+
+		if err != nil {
+			decisions[i].keep = true
+			decisions[i].reason = "unparsable date"
+			continue
+		}
+
+		if entry.Status == STATUS_SPOOLED {
+			decisions[i].keep = true
+			decisions[i].reason = STATUS_SPOOLED
+			continue
+		}
+
+		if !entry.succeeded() {
+			failed = append(failed, datedEntry{i, date})
+			continue
+		}
+
+		if date.After(newestSuccess) {
+			newestSuccess = date
+		}
+
+		dated = append(dated, datedEntry{i, date})
+	}
+
+	// Newest first
+	sort.SliceStable(dated, func(a, b int) bool {
+		return dated[a].date.After(dated[b].date)
+	})
+
+	for _, rule := range r.rules() {
+		kept := 0
+		lastPeriod := ""
+
+		for _, item := range dated {
+			if kept >= rule.count {
+				break
+			}
+
+			period := rule.period(item.date)
+
+			if period == lastPeriod {
+				continue
+			}
+
+			lastPeriod = period
+			kept++
+
+			decision := &decisions[item.index]
+			decision.keep = true
+
+			if decision.reason != "" {
+				decision.reason += ", "
+			}
+
+			decision.reason += rule.name
+		}
+	}
+
+	for _, item := range failed {
+		decision := &decisions[item.index]
+		decision.keep = item.date.After(newestSuccess)
+		decision.reason = decision.entry.Status
+	}
+
+	for i := range decisions {
+		if !decisions[i].keep && decisions[i].reason == "" {
+			decisions[i].reason = "no rule matched"
+		}
+	}
+
+	return decisions
+}
+
+// Finds the target an entry belongs to. Entries created before targets were
+// recorded get it from their file name, <target>-<date>-<id>.<extension>
+func entryTarget(entry listEntry) string {
+	if entry.Target != "" {
+		return entry.Target
+	}
+
+	parts := strings.Split(path.Base(entry.FilePath), "-")
+
+	if len(parts) < 3 {
+		return ""
+	}
+
+	return strings.Join(parts[:len(parts)-2], "-")
+}
+
+func printRetentionTable(decisions []retentionDecision) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTARGET\tDATE\tACTION\tREASON")
+
+	for _, decision := range decisions {
+		action := "prune"
+
+		if decision.keep {
+			action = "keep"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", decision.entry.Id, decision.target, decision.entry.Date, action, decision.reason)
+	}
+
+	writer.Flush()
+}
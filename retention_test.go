@@ -0,0 +1,150 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// Returns an entry named id, made at date, e.g. "2025-01-31T18:00"
+func retentionEntry(id string, date string, status string) listEntry {
+	return listEntry{Id: id, Date: date + ":00Z", Status: status}
+}
+
+func TestRetentionApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention retention
+		entries   []listEntry
+		wantKept  []string
+	}{
+		{
+			"last",
+			retention{KeepLast: 2},
+			[]listEntry{
+				retentionEntry("a", "2025-01-01T10:00", STATUS_OK),
+				retentionEntry("b", "2025-01-01T11:00", STATUS_OK),
+				retentionEntry("c", "2025-01-01T12:00", STATUS_OK),
+			},
+			[]string{"b", "c"},
+		},
+		{
+			"daily keeps the newest of each day",
+			retention{KeepDaily: 2},
+			[]listEntry{
+				retentionEntry("a", "2025-01-01T18:00", STATUS_OK),
+				retentionEntry("b", "2025-01-02T18:00", STATUS_OK),
+				retentionEntry("c", "2025-01-03T10:00", STATUS_OK),
+				retentionEntry("d", "2025-01-03T18:00", STATUS_OK),
+			},
+			[]string{"b", "d"},
+		},
+		{
+			// 2024-12-30 is in the first ISO week of 2025.
+			"weekly across the end of a year",
+			retention{KeepWeekly: 2},
+			[]listEntry{
+				retentionEntry("a", "2024-12-22T12:00", STATUS_OK),
+				retentionEntry("b", "2024-12-29T12:00", STATUS_OK),
+				retentionEntry("c", "2024-12-30T12:00", STATUS_OK),
+				retentionEntry("d", "2025-01-05T12:00", STATUS_OK),
+			},
+			[]string{"b", "d"},
+		},
+		{
+			"monthly and yearly",
+			retention{KeepMonthly: 2, KeepYearly: 2},
+			[]listEntry{
+				retentionEntry("a", "2023-06-01T12:00", STATUS_OK),
+				retentionEntry("b", "2023-12-31T12:00", STATUS_OK),
+				retentionEntry("c", "2024-11-15T12:00", STATUS_OK),
+				retentionEntry("d", "2024-11-30T12:00", STATUS_OK),
+				retentionEntry("e", "2024-12-01T12:00", STATUS_OK),
+			},
+			[]string{"b", "d", "e"},
+		},
+		{
+			"failed backups are kept until a newer one succeeds",
+			retention{KeepLast: 1},
+			[]listEntry{
+				retentionEntry("a", "2025-01-01T10:00", STATUS_FAILED),
+				retentionEntry("b", "2025-01-01T11:00", STATUS_OK),
+				retentionEntry("c", "2025-01-01T12:00", STATUS_DEFERRED),
+				retentionEntry("d", "2025-01-01T13:00", STATUS_FAILED),
+			},
+			[]string{"b", "c", "d"},
+		},
+		{
+			"failed backups don't count towards rules",
+			retention{KeepLast: 1},
+			[]listEntry{
+				retentionEntry("a", "2025-01-01T10:00", STATUS_OK),
+				retentionEntry("b", "2025-01-01T11:00", STATUS_SKIPPED),
+			},
+			[]string{"a", "b"},
+		},
+		{
+			"spooled and undated backups are kept",
+			retention{KeepLast: 1},
+			[]listEntry{
+				retentionEntry("a", "2025-01-01T10:00", STATUS_SPOOLED),
+				{Id: "b", Date: "yesterday", Status: STATUS_OK},
+				retentionEntry("c", "2025-01-01T11:00", STATUS_OK),
+				retentionEntry("d", "2025-01-01T12:00", STATUS_OK),
+			},
+			[]string{"a", "b", "d"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var kept []string
+
+			for _, decision := range test.retention.apply("world", test.entries) {
+				if decision.keep {
+					kept = append(kept, decision.entry.Id)
+				}
+
+				if decision.reason == "" {
+					t.Errorf("entry %s has no reason", decision.entry.Id)
+				}
+			}
+
+			if !slices.Equal(kept, test.wantKept) {
+				t.Errorf("kept %v, want %v", kept, test.wantKept)
+			}
+		})
+	}
+}
+
+func TestRetentionReasons(t *testing.T) {
+	entries := []listEntry{
+		retentionEntry("a", "2024-12-31T12:00", STATUS_OK),
+		retentionEntry("b", "2025-01-01T12:00", STATUS_OK),
+	}
+
+	decisions := retention{KeepLast: 1, KeepDaily: 2, KeepYearly: 1}.apply("world", entries)
+	want := []string{"daily", "last, daily, yearly"}
+
+	for i, decision := range decisions {
+		if decision.reason != want[i] {
+			t.Errorf("entry %s has reason %q, want %q", decision.entry.Id, decision.reason, want[i])
+		}
+	}
+}
+
+func TestEntryTarget(t *testing.T) {
+	tests := []struct {
+		entry listEntry
+		want  string
+	}{
+		{listEntry{Target: "world", FilePath: "/backups/other-1Jan2025-abc.tar.gz"}, "world"},
+		{listEntry{FilePath: "https://dav.example.com/backups/survival-world-1Jan2025-abc.zip"}, "survival-world"},
+		{listEntry{FilePath: "/backups/world.zip"}, ""},
+	}
+
+	for _, test := range tests {
+		if got := entryTarget(test.entry); got != test.want {
+			t.Errorf("entryTarget(%+v) = %q, want %q", test.entry, got, test.want)
+		}
+	}
+}
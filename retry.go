@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+const DEFAULT_RETRY_ATTEMPTS = 3
+const DEFAULT_RETRY_BASE_DELAY = time.Second
+const DEFAULT_RETRY_MAX_DELAY = 30 * time.Second
+const DEFAULT_RETRY_JITTER = 0.2
+
+// Timeouts, rate limits and server errors that usually go away on their own
+var DEFAULT_RETRYABLE_STATUS = []int{408, 425, 429, 500, 502, 503, 504}
+
+func (r retryPolicy) validate() error {
+	durations := []struct{ name, value string }{{"baseDelay", r.BaseDelay}, {"maxDelay", r.MaxDelay}}
+
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+
+		if _, err := time.ParseDuration(duration.value); err != nil {
+			return fmt.Errorf("Invalid %s: %w", duration.name, err)
+		}
+	}
+
+	if r.MaxAttempts < 0 {
+		return errors.New("The maxAttempts option can't be negative")
+	}
+
+	if r.Jitter != nil && (*r.Jitter < 0 || *r.Jitter > 1) {
+		return errors.New("The jitter option must be between 0 and 1")
+	}
+
+	return nil
+}
+
+func (r retryPolicy) attempts() int {
+	if r.MaxAttempts == 0 {
+		return DEFAULT_RETRY_ATTEMPTS
+	}
+
+	return r.MaxAttempts
+}
+
+// Returns how long to wait before a retry, starting with 1 for the first one.
+// The delay doubles with every retry up to MaxDelay, and up to Jitter of it
+// is taken off at random, so retries of parallel uploads are spread out.
+func (r retryPolicy) delay(retry int) time.Duration {
+	baseDelay := parseDurationOr(r.BaseDelay, DEFAULT_RETRY_BASE_DELAY)
+	maxDelay := parseDurationOr(r.MaxDelay, DEFAULT_RETRY_MAX_DELAY)
+	jitter := DEFAULT_RETRY_JITTER
+
+	if r.Jitter != nil {
+		jitter = *r.Jitter
+	}
+
+	delay := baseDelay
+
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	delay = min(delay, maxDelay)
+	return delay - time.Duration(rand.Float64()*jitter*float64(delay))
+}
+
+// Whether an operation that failed with err might succeed when tried again.
+// Errors without a status code, like dropped connections, are retried.
+func (r retryPolicy) retryable(err error) bool {
+	var statusErr gowebdav.StatusError
+
+	if errors.As(err, &statusErr) {
+		statuses := r.RetryableStatus
+
+		if statuses == nil {
+			statuses = DEFAULT_RETRYABLE_STATUS
+		}
+
+		return slices.Contains(statuses, statusErr.Status)
+	}
+
+	return !errors.Is(err, exec.ErrNotFound)
+}
+
+// Runs fn until it succeeds, fails with an error that isn't retryable, or
+// has been attempted MaxAttempts times. Retries are logged to logger.
+func (r retryPolicy) do(logger *log.Logger, operation string, fn func() error) error {
+	attempts := r.attempts()
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+
+		if err == nil || attempt >= attempts || !r.retryable(err) {
+			return err
+		}
+
+		delay := r.delay(attempt)
+		logger.Printf("%s failed (attempt %d/%d), retrying in %s: %s", operation, attempt, attempts, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const DEFAULT_PART_SIZE = 64 * MEBIBYTE // 64 MiB
+
+// S3 requires every part except the last one to be at least 5 MiB.
+const MIN_PART_SIZE = 5 * MEBIBYTE
+
+type s3Remote struct {
+	name string
+	remote
+
+	client   *minio.Client
+	partSize uint64
+
+	// Prefix of the keys of uploaded objects, the destDir without leading
+	// slashes and with a trailing one, or empty
+	prefix string
+}
+
+func init() {
+	registerRemote("s3", newS3Remote)
+}
+
+func newS3Remote(name string, options remote) (Remote, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, fmt.Errorf("The endpoint and bucket options are required")
+	}
+
+	endpoint := options.Endpoint
+	secure := true
+
+	// Plain HTTP is mostly used for local MinIO or Garage instances.
+	if after, found := strings.CutPrefix(endpoint, "http://"); found {
+		endpoint = after
+		secure = false
+	} else {
+		endpoint = strings.TrimPrefix(endpoint, "https://")
+	}
+
+	client, err := minio.New(strings.TrimSuffix(endpoint, "/"), &minio.Options{
+		Creds:  credentials.NewStaticV4(options.AccessKey, options.SecretKey, ""),
+		Secure: secure,
+		Region: options.Region,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while creating S3 client: %w", err)
+	}
+
+	partSize := uint64(DEFAULT_PART_SIZE)
+
+	if options.PartSize != 0 {
+		partSize = uint64(options.PartSize) * MEBIBYTE
+	}
+
+	if partSize < MIN_PART_SIZE {
+		return nil, fmt.Errorf("The partSize of remote \"%s\" must be at least %d MiB", name, MIN_PART_SIZE/MEBIBYTE)
+	}
+
+	return &s3Remote{name: name, remote: options, client: client, partSize: partSize, prefix: keyPrefix(options.DestDir)}, nil
+}
+
+// Object keys don't start with a slash, and a key prefix has to end with one
+// to only match the objects in that "directory".
+func keyPrefix(destDir string) string {
+	prefix := strings.Trim(path.Clean("/"+destDir), "/")
+
+	if prefix == "" {
+		return ""
+	}
+
+	return prefix + "/"
+}
+
+// Returns the key of the object fileName is uploaded to.
+func (s *s3Remote) fileKey(fileName string) string {
+	return s.prefix + fileName
+}
+
+// Converts an object key into the s3://bucket/key form stored in the backup list.
+func (s *s3Remote) objectUrl(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.Bucket, key)
+}
+
+// Converts an s3://bucket/key URL back into an object key.
+func (s *s3Remote) objectKey(objectUrl string) (string, error) {
+	key, found := strings.CutPrefix(objectUrl, fmt.Sprintf("s3://%s/", s.Bucket))
+
+	if !found {
+		return "", fmt.Errorf("The URL %s does not belong to S3 remote \"%s\"", objectUrl, s.name)
+	}
+
+	return key, nil
+}
+
+// Returns: Destination URL, Error
+func (s *s3Remote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	file, err := os.Open(inputFile)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while opening input file: %w", err)
+	}
+
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+
+	if err != nil {
+		return "", fmt.Errorf("Error while getting file information: %w", err)
+	}
+
+	return s.UploadStream(file, fileStat.Size(), fileName, logger)
+}
+
+// Uploads input with a multipart upload, holding one part in memory at a time.
+//
+// Returns: Destination URL, Error
+func (s *s3Remote) UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error) {
+	key := s.fileKey(fileName)
+	destUrl := s.objectUrl(key)
+
+	info, err := s.client.PutObject(context.Background(), s.Bucket, key, input, fileSize, minio.PutObjectOptions{
+		PartSize:    s.partSize,
+		ContentType: "application/octet-stream",
+	})
+
+	if err != nil {
+		return destUrl, fmt.Errorf("Error while uploading to S3 remote \"%s\": %w", s.name, err)
+	}
+
+	logger.Printf("Upload to S3 target \"%s\" completed. %d MiB uploaded to %s\n", s.name, info.Size/MEBIBYTE, destUrl)
+	return destUrl, nil
+}
+
+func (s *s3Remote) List() ([]remoteFile, error) {
+	var files []remoteFile
+
+	for object := range s.client.ListObjects(context.Background(), s.Bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("Error while listing files on S3 remote \"%s\": %w", s.name, object.Err)
+		}
+
+		// Common prefixes, which are similar to directories
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+
+		files = append(files, remoteFile{Path: s.objectUrl(object.Key), Size: object.Size, ModTime: object.LastModified})
+	}
+
+	return files, nil
+}
+
+func (s *s3Remote) Download(objectUrl string, output io.Writer) error {
+	key, err := s.objectKey(objectUrl)
+
+	if err != nil {
+		return err
+	}
+
+	object, err := s.client.GetObject(context.Background(), s.Bucket, key, minio.GetObjectOptions{})
+
+	if err != nil {
+		return fmt.Errorf("Error while downloading file from S3 remote \"%s\": %w", s.name, err)
+	}
+
+	defer object.Close()
+
+	_, err = io.Copy(output, object)
+	return err
+}
+
+func (s *s3Remote) Delete(objectUrl string) error {
+	key, err := s.objectKey(objectUrl)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.client.RemoveObject(context.Background(), s.Bucket, key, minio.RemoveObjectOptions{})
+
+	if err != nil {
+		return fmt.Errorf("Error while deleting file from S3 remote \"%s\": %w", s.name, err)
+	}
+
+	return nil
+}
+
+func (s *s3Remote) Stat(objectUrl string) (remoteFile, error) {
+	key, err := s.objectKey(objectUrl)
+
+	if err != nil {
+		return remoteFile{}, err
+	}
+
+	info, err := s.client.StatObject(context.Background(), s.Bucket, key, minio.StatObjectOptions{})
+
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("Error while getting file information from S3 remote \"%s\": %w", s.name, err)
+	}
+
+	return remoteFile{Path: objectUrl, Size: info.Size, ModTime: info.LastModified}, nil
+}
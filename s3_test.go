@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Records the requests made to it and answers like an S3 bucket with the
+// object keys in objects.
+type fakeS3 struct {
+	mu       sync.Mutex
+	requests []string
+	prefixes []string
+	objects  []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Has("list-type"):
+		prefix := r.URL.Query().Get("prefix")
+		f.prefixes = append(f.prefixes, prefix)
+
+		var contents strings.Builder
+
+		for _, key := range f.objects {
+			if strings.HasPrefix(key, prefix) {
+				fmt.Fprintf(&contents, "<Contents><Key>%s</Key><LastModified>2025-01-01T00:00:00.000Z</LastModified><ETag>\"0\"</ETag><Size>3</Size></Contents>", key)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><Prefix>%s</Prefix><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>%s</ListBucketResult>`, prefix, contents.String())
+	case r.Method == http.MethodPut:
+		w.Header().Set("ETag", "\"0\"")
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestS3Remote(t *testing.T, destDir string, fake *fakeS3) *s3Remote {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	remote, err := newS3Remote("s3", remote{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		DestDir:   destDir,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return remote.(*s3Remote)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		destDir string
+		want    string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"backups", "backups/"},
+		{"/backups", "backups/"},
+		{"backups/", "backups/"},
+		{"/servers//paper/", "servers/paper/"},
+	}
+
+	for _, test := range tests {
+		if got := keyPrefix(test.destDir); got != test.want {
+			t.Errorf("keyPrefix(%q) = %q, want %q", test.destDir, got, test.want)
+		}
+	}
+}
+
+func TestS3UploadListDelete(t *testing.T) {
+	tests := []struct {
+		destDir string
+		wantKey string
+	}{
+		{"", "world.tar.gz"},
+		{"backups", "backups/world.tar.gz"},
+		{"/backups/", "backups/world.tar.gz"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.destDir, func(t *testing.T) {
+			fake := &fakeS3{}
+			s := newTestS3Remote(t, test.destDir, fake)
+			logger := log.New(io.Discard, "", 0)
+
+			destUrl, err := s.UploadStream(strings.NewReader("abc"), 3, "world.tar.gz", logger)
+
+			if err != nil {
+				t.Fatalf("UploadStream() error = %v", err)
+			}
+
+			if want := "s3://bucket/" + test.wantKey; destUrl != want {
+				t.Errorf("UploadStream() = %s, want %s", destUrl, want)
+			}
+
+			fake.objects = []string{test.wantKey, "backups-old/other.tar.gz", "backups/dir/"}
+			files, err := s.List()
+
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+
+			if fake.prefixes[0] != s.prefix {
+				t.Errorf("List() used prefix %q, want %q", fake.prefixes[0], s.prefix)
+			}
+
+			found := false
+
+			for _, file := range files {
+				if strings.HasSuffix(file.Path, "/") {
+					t.Errorf("List() returned the directory %s", file.Path)
+				}
+
+				if file.Path == destUrl {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("List() = %v, missing the uploaded %s", files, destUrl)
+			}
+
+			if err = s.Delete(destUrl); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+
+			wantRequests := []string{
+				"PUT /bucket/" + test.wantKey,
+				"GET /bucket/",
+				"DELETE /bucket/" + test.wantKey,
+			}
+
+			if strings.Join(fake.requests, "\n") != strings.Join(wantRequests, "\n") {
+				t.Errorf("requests = %q, want %q", fake.requests, wantRequests)
+			}
+		})
+	}
+}
+
+func TestS3ListWithoutDestDir(t *testing.T) {
+	fake := &fakeS3{objects: []string{"a.tar.gz", "backups/b.tar.gz"}}
+	s := newTestS3Remote(t, "", fake)
+
+	files, err := s.List()
+
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Errorf("List() = %v, want every object in the bucket", files)
+	}
+}
+
+func TestS3ObjectKey(t *testing.T) {
+	s := newTestS3Remote(t, "backups", &fakeS3{})
+
+	if _, err := s.objectKey("s3://other/backups/a.tar.gz"); err == nil {
+		t.Error("objectKey() accepted a URL of another bucket")
+	}
+
+	key, err := s.objectKey("s3://bucket/backups/a.tar.gz")
+
+	if err != nil || key != "backups/a.tar.gz" {
+		t.Errorf("objectKey() = %q, %v, want backups/a.tar.gz", key, err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const DEFAULT_SSH_PORT = 22
+
+type sftpRemote struct {
+	name string
+	remote
+
+	// host:port
+	address string
+	config  *ssh.ClientConfig
+}
+
+func init() {
+	registerRemote("sftp", newSftpRemote)
+}
+
+func newSftpRemote(name string, options remote) (Remote, error) {
+	if options.Host == "" || options.User == "" {
+		return nil, fmt.Errorf("The host and user options are required")
+	}
+
+	port := options.Port
+
+	if port == 0 {
+		port = DEFAULT_SSH_PORT
+	}
+
+	var auth []ssh.AuthMethod
+
+	if options.PrivateKey != "" {
+		key, err := os.ReadFile(options.PrivateKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read private key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse private key: %w", err)
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if options.Password != "" {
+		auth = append(auth, ssh.Password(options.Password))
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("Either the password or privateKey option is required")
+	}
+
+	knownHostsFile := options.KnownHosts
+
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find the default known_hosts file: %w", err)
+		}
+
+		knownHostsFile = path.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load known hosts: %w", err)
+	}
+
+	return &sftpRemote{
+		name:    name,
+		remote:  options,
+		address: net.JoinHostPort(options.Host, strconv.Itoa(port)),
+		config: &ssh.ClientConfig{
+			User:            options.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+// Opens an SFTP session. Both returned clients must be closed by the caller.
+func (s *sftpRemote) connect() (*ssh.Client, *sftp.Client, error) {
+	sshClient, err := ssh.Dial("tcp", s.address, s.config)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error while connecting to SFTP server (Remote \"%s\"): %w", s.name, err)
+	}
+
+	client, err := sftp.NewClient(sshClient)
+
+	if err != nil {
+		sshClient.Close()
+		return nil, nil, fmt.Errorf("Error while starting SFTP session (Remote \"%s\"): %w", s.name, err)
+	}
+
+	return sshClient, client, nil
+}
+
+// Converts an absolute path on the server into an sftp:// URL.
+func (s *sftpRemote) fileUrl(filePath string) string {
+	fileUrl := url.URL{
+		Scheme: "sftp",
+		User:   url.User(s.User),
+		Host:   s.address,
+		Path:   filePath,
+	}
+
+	return fileUrl.String()
+}
+
+// Converts an sftp:// URL returned by Upload or List back into a path.
+func (s *sftpRemote) filePath(fileUrl string) (string, error) {
+	parsed, err := url.Parse(fileUrl)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while parsing file URL: %w", err)
+	}
+
+	if parsed.Scheme != "sftp" || parsed.Host != s.address {
+		return "", fmt.Errorf("The URL %s does not belong to SFTP remote \"%s\"", fileUrl, s.name)
+	}
+
+	return parsed.Path, nil
+}
+
+// Returns: Destination URL, Error
+func (s *sftpRemote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	file, err := os.Open(inputFile)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while opening input file: %w", err)
+	}
+
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+
+	if err != nil {
+		return "", fmt.Errorf("Error while getting file information: %w", err)
+	}
+
+	return s.UploadStream(file, fileStat.Size(), fileName, logger)
+}
+
+// Writes input into a hidden temporary file, then renames it once the upload
+// has finished so partially uploaded files never look complete.
+//
+// Returns: Destination URL, Error
+func (s *sftpRemote) UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error) {
+	sshClient, client, err := s.connect()
+
+	if err != nil {
+		return "", err
+	}
+
+	defer sshClient.Close()
+	defer client.Close()
+
+	destDir := s.DestDir
+
+	if destDir == "" {
+		destDir = "."
+	}
+
+	err = client.MkdirAll(destDir)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while creating destination directory: %w", err)
+	}
+
+	// Relative paths are relative to the user's home directory.
+	destDir, err = client.RealPath(destDir)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while resolving destination directory: %w", err)
+	}
+
+	destPath := path.Join(destDir, fileName)
+	destUrl := s.fileUrl(destPath)
+	tempPath := path.Join(destDir, partialName(fileName))
+
+	err = s.writeFile(client, tempPath, input)
+
+	if err != nil {
+		client.Remove(tempPath)
+		return destUrl, err
+	}
+
+	// Plain SFTP renames fail if the destination exists, which is only
+	// possible when the same backup is uploaded twice.
+	if _, supported := client.HasExtension("posix-rename@openssh.com"); supported {
+		err = client.PosixRename(tempPath, destPath)
+	} else {
+		err = client.Rename(tempPath, destPath)
+	}
+
+	if err != nil {
+		return destUrl, fmt.Errorf("Error while moving the uploaded file into place: %w", err)
+	}
+
+	logger.Printf("Upload to SFTP target \"%s\" completed. File is uploaded to %s\n", s.name, destUrl)
+	return destUrl, nil
+}
+
+func (s *sftpRemote) writeFile(client *sftp.Client, filePath string, input io.Reader) error {
+	file, err := client.Create(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while creating remote file: %w", err)
+	}
+
+	defer file.Close()
+
+	_, err = file.ReadFrom(input)
+
+	if err != nil {
+		return fmt.Errorf("Error while uploading file: %w", err)
+	}
+
+	// Not every server supports the fsync extension.
+	if _, supported := client.HasExtension("fsync@openssh.com"); supported {
+		err = file.Sync()
+
+		if err != nil {
+			return fmt.Errorf("Error while syncing remote file: %w", err)
+		}
+	}
+
+	return file.Close()
+}
+
+func (s *sftpRemote) List() ([]remoteFile, error) {
+	sshClient, client, err := s.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer sshClient.Close()
+	defer client.Close()
+
+	destDir := s.DestDir
+
+	if destDir == "" {
+		destDir = "."
+	}
+
+	destDir, err = client.RealPath(destDir)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while resolving destination directory: %w", err)
+	}
+
+	infos, err := client.ReadDir(destDir)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while listing files on SFTP remote \"%s\": %w", s.name, err)
+	}
+
+	var files []remoteFile
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		files = append(files, remoteFile{
+			Path:    s.fileUrl(path.Join(destDir, info.Name())),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return files, nil
+}
+
+func (s *sftpRemote) Download(fileUrl string, output io.Writer) error {
+	filePath, err := s.filePath(fileUrl)
+
+	if err != nil {
+		return err
+	}
+
+	sshClient, client, err := s.connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer sshClient.Close()
+	defer client.Close()
+
+	file, err := client.Open(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while downloading file from SFTP remote \"%s\": %w", s.name, err)
+	}
+
+	defer file.Close()
+
+	_, err = file.WriteTo(output)
+	return err
+}
+
+func (s *sftpRemote) Delete(fileUrl string) error {
+	filePath, err := s.filePath(fileUrl)
+
+	if err != nil {
+		return err
+	}
+
+	sshClient, client, err := s.connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer sshClient.Close()
+	defer client.Close()
+
+	err = client.Remove(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while deleting file from SFTP remote \"%s\": %w", s.name, err)
+	}
+
+	return nil
+}
+
+func (s *sftpRemote) Stat(fileUrl string) (remoteFile, error) {
+	filePath, err := s.filePath(fileUrl)
+
+	if err != nil {
+		return remoteFile{}, err
+	}
+
+	sshClient, client, err := s.connect()
+
+	if err != nil {
+		return remoteFile{}, err
+	}
+
+	defer sshClient.Close()
+	defer client.Close()
+
+	info, err := client.Stat(filePath)
+
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("Error while getting file information from SFTP remote \"%s\": %w", s.name, err)
+	}
+
+	return remoteFile{Path: fileUrl, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
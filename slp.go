@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Values of the action option of playerCheck
+const (
+	PLAYER_CHECK_DEFER = "defer"
+	PLAYER_CHECK_SKIP  = "skip"
+)
+
+const DEFAULT_MINECRAFT_PORT = "25565"
+const DEFAULT_RETRY_INTERVAL = 10 * time.Minute
+const DEFAULT_DEFER_DEADLINE = 2 * time.Hour
+const SERVER_LIST_PING_TIMEOUT = 10 * time.Second
+
+// The parts of a Server List Ping status response that QBS uses.
+type serverStatus struct {
+	Players struct {
+		Online int
+		Max    int
+	}
+}
+
+// Asks a Minecraft server for its status through the Server List Ping
+// protocol of Minecraft 1.7 and newer.
+func pingServer(address string) (serverStatus, error) {
+	var status serverStatus
+	host, portValue, err := net.SplitHostPort(address)
+
+	if err != nil {
+		host = address
+		portValue = DEFAULT_MINECRAFT_PORT
+	}
+
+	port, err := strconv.ParseUint(portValue, 10, 16)
+
+	if err != nil {
+		return status, fmt.Errorf("Invalid port \"%s\"", portValue)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, portValue), SERVER_LIST_PING_TIMEOUT)
+
+	if err != nil {
+		return status, err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SERVER_LIST_PING_TIMEOUT))
+
+	// Handshake: packet ID, protocol version, server address, port, and the
+	// next state, which is 1 for status. Servers answer status requests of
+	// any protocol version, so -1 is sent as the version like most clients.
+	var handshake bytes.Buffer
+	handshake.Write(binary.AppendUvarint(nil, 0))
+	handshake.Write(binary.AppendUvarint(nil, 0xffffffff))
+	handshake.Write(binary.AppendUvarint(nil, uint64(len(host))))
+	handshake.WriteString(host)
+	binary.Write(&handshake, binary.BigEndian, uint16(port))
+	handshake.Write(binary.AppendUvarint(nil, 1))
+
+	// Status request, a packet with only its ID
+	statusRequest := []byte{0}
+
+	var packets []byte
+
+	for _, packet := range [][]byte{handshake.Bytes(), statusRequest} {
+		packets = binary.AppendUvarint(packets, uint64(len(packet)))
+		packets = append(packets, packet...)
+	}
+
+	_, err = conn.Write(packets)
+
+	if err != nil {
+		return status, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	if _, err = binary.ReadUvarint(reader); err != nil {
+		return status, fmt.Errorf("Error while reading status response: %w", err)
+	}
+
+	packetId, err := binary.ReadUvarint(reader)
+
+	if err != nil || packetId != 0 {
+		return status, errors.New("Unexpected status response")
+	}
+
+	jsonLength, err := binary.ReadUvarint(reader)
+
+	if err != nil || jsonLength > MEBIBYTE {
+		return status, errors.New("Invalid status response length")
+	}
+
+	content := make([]byte, jsonLength)
+	_, err = io.ReadFull(reader, content)
+
+	if err != nil {
+		return status, fmt.Errorf("Error while reading status response: %w", err)
+	}
+
+	err = json.Unmarshal(content, &status)
+
+	if err != nil {
+		return status, fmt.Errorf("Unable to parse status response: %w", err)
+	}
+
+	return status, nil
+}
+
+func (p playerCheck) enabled() bool {
+	return p.Address != ""
+}
+
+func (p playerCheck) validate() error {
+	for _, duration := range []string{p.RetryInterval, p.Deadline} {
+		if duration == "" {
+			continue
+		}
+
+		if _, err := time.ParseDuration(duration); err != nil {
+			return err
+		}
+	}
+
+	switch p.Action {
+	case "", PLAYER_CHECK_DEFER, PLAYER_CHECK_SKIP:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown action \"%s\", Expected one of: %s, %s", p.Action, PLAYER_CHECK_DEFER, PLAYER_CHECK_SKIP)
+}
+
+// Whether more players than allowed are online. Servers that can't be
+// reached have nobody online to disturb.
+func (p playerCheck) busy(logger *log.Logger) bool {
+	status, err := pingServer(p.Address)
+
+	if err != nil {
+		logger.Printf("Unable to get the player count from %s, backing up anyway: %s", p.Address, err)
+		return false
+	}
+
+	if status.Players.Online > p.MaxPlayers {
+		logger.Printf("%d players are online, more than the allowed %d", status.Players.Online, p.MaxPlayers)
+		return true
+	}
+
+	return false
+}
+
+// Waits until few enough players are online, if the action is to defer.
+//
+// Returns: STATUS_DEFERRED or STATUS_SKIPPED if the target shouldn't be
+// backed up, otherwise nothing
+func (p playerCheck) wait(logger *log.Logger) string {
+	if !p.busy(logger) {
+		return ""
+	}
+
+	if p.Action == PLAYER_CHECK_SKIP {
+		return STATUS_SKIPPED
+	}
+
+	interval := parseDurationOr(p.RetryInterval, DEFAULT_RETRY_INTERVAL)
+	deadline := time.Now().Add(parseDurationOr(p.Deadline, DEFAULT_DEFER_DEADLINE))
+
+	for !time.Now().Add(interval).After(deadline) {
+		logger.Printf("Deferring the backup, checking again in %s", interval)
+		time.Sleep(interval)
+
+		if !p.busy(logger) {
+			return ""
+		}
+	}
+
+	return STATUS_DEFERRED
+}
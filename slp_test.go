@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+// Starts a server on localhost which reads a handshake and a status request,
+// then answers with a status response of packetId and content.
+func startSlpServer(t *testing.T, packetId uint64, content string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		// Handshake and status request
+		for range 2 {
+			length, err := binary.ReadUvarint(reader)
+
+			if err != nil {
+				return
+			}
+
+			if _, err = io.CopyN(io.Discard, reader, int64(length)); err != nil {
+				return
+			}
+		}
+
+		packet := binary.AppendUvarint(nil, packetId)
+		packet = binary.AppendUvarint(packet, uint64(len(content)))
+		packet = append(packet, content...)
+
+		conn.Write(append(binary.AppendUvarint(nil, uint64(len(packet))), packet...))
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestPingServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		packetId   uint64
+		content    string
+		wantOnline int
+		wantErr    bool
+	}{
+		{"status response", 0, `{"players":{"online":3,"max":20}}`, 3, false},
+		{"nobody online", 0, `{"players":{"online":0,"max":20}}`, 0, false},
+		{"wrong packet", 1, `{}`, 0, true},
+		{"invalid JSON", 0, `{"players":`, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, err := pingServer(startSlpServer(t, test.packetId, test.content))
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("pingServer() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if status.Players.Online != test.wantOnline {
+				t.Errorf("pingServer() online = %d, want %d", status.Players.Online, test.wantOnline)
+			}
+		})
+	}
+}
+
+func TestPlayerCheckWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		online string
+		check  playerCheck
+		want   string
+	}{
+		{"few enough players", "1", playerCheck{MaxPlayers: 1, Action: PLAYER_CHECK_SKIP}, ""},
+		{"skipped", "2", playerCheck{MaxPlayers: 1, Action: PLAYER_CHECK_SKIP}, STATUS_SKIPPED},
+		{"deadline before the first retry", "2", playerCheck{MaxPlayers: 1, RetryInterval: "1h", Deadline: "1m"}, STATUS_DEFERRED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.check.Address = startSlpServer(t, 0, `{"players":{"online":`+test.online+`,"max":20}}`)
+
+			if got := test.check.wait(log.New(io.Discard, "", 0)); got != test.want {
+				t.Errorf("wait() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Directory in ArchiveDir which is used as the spool if spool.dir isn't set
+const DEFAULT_SPOOL_DIR = "spool"
+const DEFAULT_SPOOL_MAX_AGE = 7 * 24 * time.Hour
+
+const SPOOL_METADATA_SUFFIX = ".json"
+
+// Suffix of the state of a spooled archive's unfinished upload
+const SPOOL_UPLOAD_STATE_SUFFIX = ".upload"
+
+// Metadata of an archive in the spool, saved next to it.
+type spoolItem struct {
+	// The backup which is recorded in the backup list once the archive is
+	// uploaded
+	Entry    listEntry
+	FileName string
+
+	// When the upload failed
+	Spooled time.Time
+
+	archivePath  string
+	metadataPath string
+}
+
+// Moves an archive whose upload failed into the spool, so the upload can be
+// tried again later. entry is the backup which is recorded in the backup list
+// once that succeeds.
+func (c *config) spoolArchive(outPath string, fileName string, entry listEntry, logger *log.Logger) error {
+	if c.Spool.MaxSize > 0 && entry.Size > c.spoolMaxBytes() {
+		return fmt.Errorf("The archive is larger than the spool's maxSize of %d MiB", c.Spool.MaxSize)
+	}
+
+	err := os.MkdirAll(c.Spool.Dir, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	// If another run is flushing the spool, the limits are enforced by it.
+	if lock, locked := c.lockSpool(); locked {
+		c.limitSpool(c.loadSpool(), entry.Size)
+		defer lock.Unlock()
+	}
+
+	item := spoolItem{
+		Entry:        entry,
+		FileName:     fileName,
+		Spooled:      time.Now(),
+		archivePath:  path.Join(c.Spool.Dir, fileName),
+		metadataPath: path.Join(c.Spool.Dir, fileName+SPOOL_METADATA_SUFFIX),
+	}
+
+	if err = moveFile(outPath, item.archivePath); err != nil {
+		return err
+	}
+
+	if err = item.save(); err != nil {
+		moveFile(item.archivePath, outPath)
+		return fmt.Errorf("Unable to save the spool metadata: %w", err)
+	}
+
+	item.adoptUploadState(logger)
+
+	logger.Printf("Moved %s into the spool, its upload will be tried again on the next run", fileName)
+	return nil
+}
+
+func (s *spoolItem) uploadStatePath() string {
+	return s.archivePath + SPOOL_UPLOAD_STATE_SUFFIX
+}
+
+// Moves the state of the archive's unfinished upload next to it, so flushing
+// the spool resumes the upload instead of starting it over. Errors are only
+// logged, since the upload can still be started over.
+func (s *spoolItem) adoptUploadState(logger *log.Logger) {
+	oldPath := uploadStatePath(s.FileName)
+	lock := flock.New(oldPath + ".lock")
+	locked, err := lock.TryLock()
+
+	if err != nil || !locked {
+		return
+	}
+
+	content, err := os.ReadFile(oldPath)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		lock.Unlock()
+		return
+	}
+
+	state := &uploadState{filePath: s.uploadStatePath(), lock: lock}
+
+	if err == nil {
+		err = json.Unmarshal(content, state)
+	}
+
+	if err == nil {
+		state.ArchivePath = s.archivePath
+		err = state.save()
+	}
+
+	if err != nil {
+		logger.Printf("Unable to move the upload state of %s into the spool: %s", s.FileName, err)
+	}
+
+	os.Remove(oldPath)
+	os.Remove(lock.Path())
+	lock.Unlock()
+}
+
+func (s *spoolItem) save() error {
+	content, err := json.Marshal(s)
+
+	if err != nil {
+		return err
+	}
+
+	tempPath := s.metadataPath + PARTIAL_SUFFIX
+	err = os.WriteFile(tempPath, content, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, s.metadataPath)
+}
+
+func (s *spoolItem) remove() {
+	os.Remove(s.archivePath)
+	os.Remove(s.metadataPath)
+	os.Remove(s.uploadStatePath())
+	os.Remove(s.uploadStatePath() + ".lock")
+}
+
+// Takes the lock of the spool without waiting, so only one run of QBS uploads
+// the spooled archives at a time.
+func (c *config) lockSpool() (*flock.Flock, bool) {
+	lock := flock.New(path.Join(c.Spool.Dir, ".lock"))
+	locked, err := lock.TryLock()
+
+	if err != nil {
+		log.Printf("Unable to lock the spool: %s", err)
+		return nil, false
+	}
+
+	return lock, locked
+}
+
+// Returns: Every archive in the spool, oldest first
+func (c *config) loadSpool() []*spoolItem {
+	files, err := filepath.Glob(path.Join(c.Spool.Dir, "*"+SPOOL_METADATA_SUFFIX))
+
+	if err != nil {
+		log.Printf("Unable to list the spool: %s", err)
+		return nil
+	}
+
+	var items []*spoolItem
+
+	for _, metadataPath := range files {
+		content, err := os.ReadFile(metadataPath)
+
+		item := &spoolItem{metadataPath: metadataPath}
+
+		if err == nil {
+			err = json.Unmarshal(content, item)
+		}
+
+		if err != nil {
+			log.Printf("Unable to read the spool metadata %s: %s", metadataPath, err)
+			continue
+		}
+
+		item.archivePath = path.Join(c.Spool.Dir, item.FileName)
+		items = append(items, item)
+	}
+
+	slices.SortFunc(items, func(a, b *spoolItem) int {
+		return a.Spooled.Compare(b.Spooled)
+	})
+
+	return items
+}
+
+func (c *config) spoolMaxBytes() int64 {
+	return int64(c.Spool.MaxSize) * 1024 * 1024
+}
+
+// Drops archives that have been spooled for longer than MaxAge, then the
+// oldest archives until the spool fits in MaxSize with reserved bytes to
+// spare. Their backups are recorded as failed.
+//
+// Returns: The archives that are left
+func (c *config) limitSpool(items []*spoolItem, reserved int64) []*spoolItem {
+	maxAge := parseDurationOr(c.Spool.MaxAge, DEFAULT_SPOOL_MAX_AGE)
+	totalSize := reserved
+
+	for _, item := range items {
+		totalSize += item.Entry.Size
+	}
+
+	var kept []*spoolItem
+
+	for _, item := range items {
+		logger := targetLogger(item.Entry.Target)
+
+		switch {
+		case time.Since(item.Spooled) > maxAge:
+			logger.Printf("Dropping %s from the spool, it was spooled more than %s ago", item.FileName, maxAge)
+		case c.Spool.MaxSize > 0 && totalSize > c.spoolMaxBytes():
+			logger.Printf("Dropping %s from the spool to keep it under %d MiB", item.FileName, c.Spool.MaxSize)
+		default:
+			kept = append(kept, item)
+			continue
+		}
+
+		totalSize -= item.Entry.Size
+		c.dropSpooled(item, logger)
+	}
+
+	return kept
+}
+
+// Deletes an archive from the spool and marks its backup as failed, unless
+// the entry has been forgotten since.
+func (c *config) dropSpooled(item *spoolItem, logger *log.Logger) {
+	c.BackupList.update(func(entries []listEntry) []listEntry {
+		for i := range entries {
+			if entries[i].Id == item.Entry.Id {
+				entries[i].Status = STATUS_FAILED
+				entries[i].FilePath = ""
+			}
+		}
+
+		return entries
+	}, logger)
+
+	item.remove()
+}
+
+// Uploads the archives in the spool again, after dropping the ones that are
+// over the spool's limits. Archives that fail again stay in the spool.
+func (c *config) flushSpool() {
+	if _, err := os.Stat(c.Spool.Dir); errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	lock, locked := c.lockSpool()
+
+	if !locked {
+		log.Println("The spool is being flushed by another run, skipping it")
+		return
+	}
+
+	defer lock.Unlock()
+
+	for _, item := range c.limitSpool(c.loadSpool(), 0) {
+		c.flushSpooled(item)
+	}
+}
+
+func (c *config) flushSpooled(item *spoolItem) {
+	entry := item.Entry
+	logger := targetLogger(entry.Target)
+
+	// The upload was resumed before the spool was flushed.
+	if recorded, found := c.BackupList.find(entry.Id); found && recorded.succeeded() {
+		c.unspool(item, logger)
+		return
+	}
+
+	remote, found := c.backends[entry.Remote]
+
+	if !found {
+		logger.Printf("Keeping %s in the spool, the remote \"%s\" no longer exists", item.FileName, entry.Remote)
+		return
+	}
+
+	if _, err := os.Stat(item.archivePath); err != nil {
+		logger.Printf("Dropping %s from the spool, its archive is gone: %s", item.FileName, err)
+		c.dropSpooled(item, logger)
+		return
+	}
+
+	logger.Printf("-- Uploading backup %s of target %s from the spool\n", entry.Id, entry.Target)
+
+	var err error
+	entry.FilePath, err = c.uploadSaved(remote, item.archivePath, item.FileName, item.uploadStatePath(), entry, logger)
+
+	if err != nil {
+		logger.Printf("Error while uploading %s from the spool, trying again on the next run: %s", item.FileName, err)
+		return
+	}
+
+	entry.Status = STATUS_OK
+	entry.ChecksumFile, err = c.uploadChecksumFile(remote, item.FileName, entry.Sha256, logger)
+
+	if err != nil {
+		logger.Printf("Error while uploading checksum file: %s", err)
+	}
+
+	c.BackupList.record(entry, logger)
+	c.unspool(item, logger)
+}
+
+// Takes an archive whose backup has been uploaded out of the spool. The
+// archive is deleted if DeleteAfterUpload is enabled, otherwise it's moved
+// back to ArchiveDir.
+func (c *config) unspool(item *spoolItem, logger *log.Logger) {
+	_, err := os.Stat(item.archivePath)
+
+	if err == nil && !c.DeleteAfterUpload {
+		err = moveFile(item.archivePath, path.Join(c.ArchiveDir, item.FileName))
+
+		if err != nil {
+			logger.Printf("Unable to move %s out of the spool: %s", item.FileName, err)
+			return
+		}
+	} else if err == nil {
+		logger.Printf("Deleting %s...", item.archivePath)
+	}
+
+	item.remove()
+}
+
+// Renames src to dst, or copies it if they're on different file systems.
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	input, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer input.Close()
+
+	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FILE_MODE)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, input)
+
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Options of the -verify command. Empty values match every entry.
+type verifyFilter struct {
+	targets []string
+	ids     []string
+
+	// Only verify this many randomly chosen backups if above 0
+	sample int
+}
+
+// The outcome of verifying a single backup.
+type verifyResult struct {
+	entry listEntry
+
+	// Number of files and directories read from the archive
+	files int
+
+	// Archive entries which couldn't be read
+	unreadable []string
+
+	// Why the backup as a whole couldn't be verified
+	err error
+
+	// Whether the checksum could be compared with the recorded one
+	checksumMatched bool
+
+	// Whether the archive is encrypted and couldn't be read without an identity
+	contentsSkipped bool
+}
+
+func (r verifyResult) ok() bool {
+	return r.err == nil && len(r.unreadable) == 0
+}
+
+// Selects the backups to verify. Only successful backups are checked.
+func (b *backupList) verifyCandidates(filter verifyFilter) []listEntry {
+	var entries []listEntry
+
+	for _, entry := range b.entries() {
+		if !entry.succeeded() || entry.FilePath == "" {
+			continue
+		}
+
+		if len(filter.targets) > 0 && !slices.Contains(filter.targets, entryTarget(entry)) {
+			continue
+		}
+
+		if len(filter.ids) > 0 && !slices.Contains(filter.ids, entry.Id) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if filter.sample > 0 && len(entries) > filter.sample {
+		rand.Shuffle(len(entries), func(i, j int) {
+			entries[i], entries[j] = entries[j], entries[i]
+		})
+
+		entries = entries[:filter.sample]
+	}
+
+	return entries
+}
+
+// Downloads the selected backups again and checks that they can be read.
+// Exits with an error status if any backup failed verification.
+func (c *config) verify(filter verifyFilter) {
+	entries := c.BackupList.verifyCandidates(filter)
+
+	if len(entries) == 0 {
+		log.Fatalln("No backups in the backup list match the given targets or IDs")
+	}
+
+	results := make([]verifyResult, 0, len(entries))
+	failed := 0
+
+	for _, entry := range entries {
+		log.Printf("-- Verifying backup %s from remote %s\n", entry.Id, entry.Remote)
+
+		result := c.verifyEntry(entry)
+		results = append(results, result)
+
+		if !result.ok() {
+			failed++
+		}
+	}
+
+	printVerifyTable(results)
+
+	if failed > 0 {
+		log.Fatalf("%d of %d backups failed verification", failed, len(results))
+	}
+
+	log.Printf("All %d backups passed verification", len(results))
+}
+
+func (c *config) verifyEntry(entry listEntry) verifyResult {
+	result := verifyResult{entry: entry}
+	remote, found := c.backends[entry.Remote]
+
+	if !found {
+		result.err = fmt.Errorf("The remote \"%s\" does not exist in the configuration file", entry.Remote)
+		return result
+	}
+
+	hash := sha256.New()
+
+	archiveName := strings.TrimSuffix(entry.FilePath, ENCRYPTED_SUFFIX)
+	encrypted := archiveName != entry.FilePath
+
+	// Encrypted archives can still be checked against their checksum on
+	// machines that only have the public keys.
+	result.contentsSkipped = encrypted && len(c.identities) == 0
+
+	if entry.Archive == ARCHIVE_REPO {
+		result.err = c.verifySnapshot(remote, entry, hash, &result)
+	} else if strings.HasSuffix(archiveName, ".zip") {
+		result.err = c.verifyZip(remote, entry, hash, &result)
+	} else {
+		result.err = c.verifyTar(remote, entry, hash, &result)
+	}
+
+	if result.err != nil {
+		return result
+	}
+
+	if entry.Sha256 == "" {
+		// Nothing at all would have been checked.
+		if result.contentsSkipped {
+			result.err = errors.New("The contents are encrypted and can't be read without an identity, and no checksum is recorded")
+		}
+
+		return result
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	if checksum != entry.Sha256 {
+		result.err = fmt.Errorf("Checksum mismatch, the remote file has SHA-256 %s but the backup list has %s", checksum, entry.Sha256)
+		return result
+	}
+
+	result.checksumMatched = true
+	return result
+}
+
+// Streams a tar archive from the remote, decompressing it and reading every
+// file in it. Tar archives can't be read past a damaged entry, so reading
+// stops at the first one.
+func (c *config) verifyTar(remote Remote, entry listEntry, hash io.Writer, result *verifyResult) error {
+	reader, writer := io.Pipe()
+	downloadErr := make(chan error, 1)
+
+	go func() {
+		err := remote.Download(entry.FilePath, writer)
+		writer.CloseWithError(err)
+		downloadErr <- err
+	}()
+
+	// Unblocks the download if reading stopped early.
+	defer reader.Close()
+
+	input := io.TeeReader(reader, hash)
+
+	if result.contentsSkipped {
+		_, err := io.Copy(io.Discard, input)
+		return firstError(<-downloadErr, err)
+	}
+
+	var archive io.Reader = input
+	archiveName := strings.TrimSuffix(entry.FilePath, ENCRYPTED_SUFFIX)
+
+	if archiveName != entry.FilePath {
+		decrypted, err := c.decrypt(input)
+
+		if err != nil {
+			reader.Close()
+			return firstError(<-downloadErr, fmt.Errorf("Failed to decrypt archive: %w", err))
+		}
+
+		archive = decrypted
+	}
+
+	decompressed, err := decompressTar(archiveName, archive)
+
+	if err != nil {
+		reader.Close()
+		return firstError(<-downloadErr, err)
+	}
+
+	defer decompressed.Close()
+
+	tarReader := tar.NewReader(decompressed)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			reader.Close()
+			return firstError(<-downloadErr, fmt.Errorf("Failed to read tar header after %d entries: %w", result.files, err))
+		}
+
+		_, err = io.Copy(io.Discard, tarReader)
+
+		if err != nil {
+			result.unreadable = append(result.unreadable, header.Name)
+			reader.Close()
+			return firstError(<-downloadErr, fmt.Errorf("Failed to read \"%s\": %w", header.Name, err))
+		}
+
+		result.files++
+	}
+
+	// Reading the rest of the decompressed stream checks the gzip trailer,
+	// and the rest of the decrypted stream authenticates the last encrypted
+	// chunk, neither of which the tar reader needs.
+	_, err = io.Copy(io.Discard, decompressed)
+
+	if err == nil {
+		err = decompressed.Close()
+	}
+
+	if err == nil {
+		_, err = io.Copy(io.Discard, archive)
+	}
+
+	if err != nil {
+		reader.Close()
+		return firstError(<-downloadErr, fmt.Errorf("Failed to read the end of the archive: %w", err))
+	}
+
+	// The compressed stream may end with padding that the tar reader
+	// didn't need, which is still part of the checksum.
+	_, err = io.Copy(io.Discard, input)
+
+	if err != nil {
+		return firstError(<-downloadErr, err)
+	}
+
+	return <-downloadErr
+}
+
+// Zip archives need random access, so they are downloaded to archiveDir first.
+// Every file is read to check its CRC-32, and damaged files don't stop the
+// remaining ones from being checked.
+func (c *config) verifyZip(remote Remote, entry listEntry, hash io.Writer, result *verifyResult) error {
+	archivePath := path.Join(c.ArchiveDir, "."+path.Base(entry.FilePath)+".verify")
+	file, err := os.Create(archivePath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary file: %w", err)
+	}
+
+	defer os.Remove(archivePath)
+	defer file.Close()
+
+	err = remote.Download(entry.FilePath, io.MultiWriter(file, hash))
+
+	if err != nil {
+		return err
+	}
+
+	if result.contentsSkipped {
+		return nil
+	}
+
+	if strings.HasSuffix(entry.FilePath, ENCRYPTED_SUFFIX) {
+		decryptedPath := strings.TrimSuffix(archivePath, ENCRYPTED_SUFFIX+".verify") + ".verify"
+		err = c.decryptFile(archivePath, decryptedPath)
+
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(decryptedPath)
+
+		file, err = os.Open(decryptedPath)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+	}
+
+	fileInfo, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	zipReader, err := zip.NewReader(file, fileInfo.Size())
+
+	if err != nil {
+		return fmt.Errorf("Failed to open zip archive: %w", err)
+	}
+
+	for _, zipFile := range zipReader.File {
+		err = readZipFile(zipFile)
+
+		if err != nil {
+			log.Printf("Unable to read \"%s\": %s", zipFile.Name, err)
+			result.unreadable = append(result.unreadable, zipFile.Name)
+			continue
+		}
+
+		result.files++
+	}
+
+	return nil
+}
+
+func readZipFile(file *zip.File) error {
+	reader, err := file.Open()
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
+
+// Prefers the download error, since it usually explains why reading failed,
+// unless the download only failed because reading stopped early.
+func firstError(downloadErr error, readErr error) error {
+	if downloadErr != nil && !errors.Is(downloadErr, io.ErrClosedPipe) {
+		return downloadErr
+	}
+
+	return readErr
+}
+
+func printVerifyTable(results []verifyResult) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTARGET\tDATE\tFILES\tRESULT\tDETAILS")
+
+	for _, result := range results {
+		status := "ok"
+		details := "checksum matches"
+
+		if !result.checksumMatched {
+			details = "no checksum recorded"
+		}
+
+		if result.contentsSkipped {
+			details += ", encrypted contents not checked"
+		}
+
+		if len(result.unreadable) > 0 {
+			status = "failed"
+			details = "unreadable: " + strings.Join(result.unreadable, ", ")
+		}
+
+		if result.err != nil {
+			status = "failed"
+			details = result.err.Error()
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%s\n", result.entry.Id, entryTarget(result.entry), result.entry.Date, result.files, status, details)
+	}
+
+	writer.Flush()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// Suffix for files that are still being uploaded when AtomicUpload is enabled.
+const PARTIAL_SUFFIX = ".part"
+
+type webdavRemote struct {
+	name string
+	remote
+
+	// The URL every WebDAV path is relative to
+	baseUrl string
+
+	// The destination directory, relative to baseUrl
+	dirPath string
+}
+
+func init() {
+	registerRemote("webdav", newWebdavRemote)
+}
+
+func newWebdavRemote(name string, options remote) (Remote, error) {
+	if _, err := url.Parse(options.Root); err != nil {
+		return nil, fmt.Errorf("Invalid root URL: %w", err)
+	}
+
+	return &webdavRemote{name: name, remote: options, baseUrl: options.Root, dirPath: options.DestDir}, nil
+}
+
+func (w *webdavRemote) client() *gowebdav.Client {
+	return gowebdav.NewClient(w.baseUrl, w.User, w.Password)
+}
+
+// Converts a URL returned by Upload or List into a path relative to baseUrl.
+func (w *webdavRemote) davPath(fileUrl string) (string, error) {
+	if !strings.HasPrefix(fileUrl, w.baseUrl) {
+		return "", fmt.Errorf("The URL %s does not belong to remote \"%s\"", fileUrl, w.name)
+	}
+
+	filePath, err := url.PathUnescape(strings.TrimPrefix(fileUrl, w.baseUrl))
+
+	if err != nil {
+		return "", fmt.Errorf("Error while decoding file path: %w", err)
+	}
+
+	return filePath, nil
+}
+
+// Returns: Destination URL, Error
+func (w *webdavRemote) Upload(inputFile string, fileName string, logger *log.Logger) (string, error) {
+	file, err := os.Open(inputFile)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while opening input file: %w", err)
+	}
+
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+
+	if err != nil {
+		return "", fmt.Errorf("Error while getting file information: %w", err)
+	}
+
+	return w.UploadStream(file, fileStat.Size(), fileName, logger)
+}
+
+// Uploads input with a single PUT request. An unknown fileSize of -1 makes
+// the request use chunked transfer encoding.
+//
+// Returns: Destination URL, Error
+func (w *webdavRemote) UploadStream(input io.Reader, fileSize int64, fileName string, logger *log.Logger) (string, error) {
+	client := w.client()
+
+	destUrl, err := url.JoinPath(w.baseUrl, w.dirPath, fileName)
+
+	if err != nil {
+		return "", fmt.Errorf("Error while joining destination URL: %w", err)
+	}
+
+	err = client.Connect()
+
+	if err != nil {
+		return destUrl, fmt.Errorf("Error while connecting to WebDAV server (Remote \"%s\"): %w", w.name, err)
+	}
+
+	destPath := path.Join(w.dirPath, fileName)
+	uploadPath := destPath
+
+	if w.AtomicUpload {
+		uploadPath = path.Join(w.dirPath, partialName(fileName))
+	}
+
+	err = client.WriteStreamWithLength(uploadPath, input, fileSize, FILE_MODE)
+
+	if err != nil {
+		if w.AtomicUpload {
+			client.Remove(uploadPath)
+		}
+
+		return destUrl, fmt.Errorf("Error while uploading file: %w", err)
+	}
+
+	if w.AtomicUpload {
+		err = client.Rename(uploadPath, destPath, true)
+
+		if err != nil {
+			return destUrl, fmt.Errorf("Error while moving the uploaded file into place: %w", err)
+		}
+	}
+
+	logger.Printf("Upload to WebDAV target \"%s\" completed. File is uploaded to %s\n", w.name, destUrl)
+	return destUrl, nil
+}
+
+func (w *webdavRemote) List() ([]remoteFile, error) {
+	infos, err := w.client().ReadDir(w.dirPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error while listing files on remote \"%s\": %w", w.name, err)
+	}
+
+	var files []remoteFile
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		fileUrl, err := url.JoinPath(w.baseUrl, w.dirPath, info.Name())
+
+		if err != nil {
+			return nil, fmt.Errorf("Error while joining file URL: %w", err)
+		}
+
+		files = append(files, remoteFile{Path: fileUrl, Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	return files, nil
+}
+
+func (w *webdavRemote) Download(fileUrl string, output io.Writer) error {
+	filePath, err := w.davPath(fileUrl)
+
+	if err != nil {
+		return err
+	}
+
+	stream, err := w.client().ReadStream(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while downloading file from remote \"%s\": %w", w.name, err)
+	}
+
+	defer stream.Close()
+
+	_, err = io.Copy(output, stream)
+	return err
+}
+
+func (w *webdavRemote) Delete(fileUrl string) error {
+	filePath, err := w.davPath(fileUrl)
+
+	if err != nil {
+		return err
+	}
+
+	err = w.client().Remove(filePath)
+
+	if err != nil {
+		return fmt.Errorf("Error while deleting file from remote \"%s\": %w", w.name, err)
+	}
+
+	return nil
+}
+
+func (w *webdavRemote) Stat(fileUrl string) (remoteFile, error) {
+	filePath, err := w.davPath(fileUrl)
+
+	if err != nil {
+		return remoteFile{}, err
+	}
+
+	info, err := w.client().Stat(filePath)
+
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("Error while getting file information from remote \"%s\": %w", w.name, err)
+	}
+
+	return remoteFile{Path: fileUrl, Size: info.Size(), ModTime: info.ModTime()}, nil
+}